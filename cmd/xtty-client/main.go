@@ -4,27 +4,73 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"os"
 
 	"github.com/Theknighttron/Xtty/internal/client"
 )
 
 func main() {
-	join := flag.String("join", "", "Room code to join")
-	username := flag.String("username", "", "Your username")
+	join := flag.String("join", "", "Room code to join (ROOM-PASSWORD or CHANNEL-WORDS)")
+	members := flag.Int("members", 0, "How many people a room you create may hold (default 2)")
+	words := flag.Bool("words", false, "Give a room you create a code of a number and words, easier to read out")
+	username := flag.String("username", "", "Your username (default from the config)")
+	configPath := flag.String("config", client.GetDefaultConfigPath(), "Config file")
+	server := flag.String("server", "", "Server as host:port or a ws:// or wss:// URL (default $"+client.ServerEnv+", then the config)")
+	changePassphrase := flag.Bool("change-passphrase", false, "Change the passphrase protecting your private key and exit")
 	flag.Parse()
 
+	if *changePassphrase {
+		if err := client.ChangePassphrase(*configPath); err != nil {
+			log.Fatalf("Failed to change passphrase: %v", err)
+		}
+		fmt.Println("Passphrase changed")
+		return
+	}
+
+	// A mistyped code is caught before anything else happens
+	if *join != "" {
+		if _, _, err := client.SplitRoomCode(*join); err != nil {
+			log.Fatalf("Can't join: %v", err)
+		}
+	}
+
+	// Long-term identity lives in the config, set up on first run
+	config, err := client.OpenConfig(*configPath, *username, client.ServerOverride(*server))
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if err := client.ResolveServer(config, *server); err != nil {
+		log.Fatalf("Invalid server: %v", err)
+	}
 	if *username == "" {
-		fmt.Println("Error: username is required")
-		fmt.Println("Usage: go run main.go -username YOURNAME [-join ROOM_CODE]")
-		os.Exit(1)
+		*username = config.Username
+	}
+
+	knownPeers, err := client.LoadKnownPeers(client.GetDefaultKnownPeersPath())
+	if err != nil {
+		log.Fatalf("Failed to load known peers: %v", err)
 	}
 
 	u := client.NewUser(*username)
+	if err := u.SetIdentity(config, knownPeers); err != nil {
+		log.Fatalf("Failed to load identity: %v", err)
+	}
+	u.SetRekeyPolicy(config.RekeyPolicy())
+	u.SetCoverTraffic(config.CoverTrafficInterval())
+	u.SetRoomSize(*members)
+	u.SetWordCodes(*words)
+
+	dialer, err := config.Dialer()
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+	u.SetDialer(dialer)
 
 	var roomCode string
 	if *join == "" {
-		roomCode = client.GenerateRoomCode()
+		roomCode, err = u.CreateRoom(config.ServerURL())
+		if err != nil {
+			log.Fatalf("Failed to create a room: %v", err)
+		}
 		fmt.Printf("Your room code: %s\n", roomCode)
 		fmt.Println("Share this with your peer to connect")
 	} else {
@@ -36,14 +82,16 @@ func main() {
 		log.Fatalf("Failed to generate keys: %v", err)
 	}
 
-	if err := u.Connect("ws://localhost:8080", roomCode); err != nil {
+	if err := u.Connect(config.ServerURL(), roomCode); err != nil {
 		log.Fatalf("Connection failed: %v", err)
 	}
 	defer u.Cleanup()
 
 	// Wait for key exchange if joining existing room
 	if *join != "" {
-		<-u.KeyExchangeDone
+		if err := u.WaitForRoom(); err != nil {
+			log.Fatalf("Could not join the room: %v", err)
+		}
 	}
 
 	ui := client.NewUI(u)
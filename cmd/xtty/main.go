@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/Theknighttron/Xtty/internal/common"
@@ -17,22 +18,45 @@ import (
 var (
 	host = flag.String("host", "localhost", "Server host")
 	port = flag.Int("port", 8080, "Server port")
+	data = flag.String("data", "xtty-data", "Directory to keep registered users in, empty to keep them in memory")
+
+	allowedOrigins = flag.String("allowed-origins", "", "Comma separated browser origins allowed to connect besides the server's own")
+
+	tlsCert       = flag.String("tls-cert", "", "TLS certificate file, serves wss:// together with -tls-key")
+	tlsKey        = flag.String("tls-key", "", "TLS private key file")
+	tlsSelfSigned = flag.Bool("tls-self-signed", false, "Serve wss:// with a generated self-signed certificate, kept in the -data directory")
+	tlsClientCA   = flag.String("tls-client-ca", "", "Require client certificates signed by a CA in this file")
 )
 
 func main() {
 	flag.Parse()
 
-	xttyServer := server.NewServer(common.ServerConfig{
+	var store server.UserStore = server.NewMemoryUserStore()
+	if *data != "" {
+		fileStore, err := server.OpenFileUserStore(*data)
+		if err != nil {
+			log.Fatalf("Error opening user store: %v", err)
+		}
+		store = fileStore
+	}
+	defer store.Close()
+
+	xttyServer := server.NewServerWithStore(common.ServerConfig{
 		Host:              *host,
 		Port:              *port,
 		MessageTTL:        7 * 24 * time.Hour,
 		HeartbeatInterval: 30 * time.Second,
-	})
+		AllowedOrigins:    splitList(*allowedOrigins),
+	}, store)
 
 	// Set up routes
 	http.HandleFunc("/ws", xttyServer.HandleWebSocket)
 	http.HandleFunc("/register", xttyServer.HandleRegistration)
+	http.HandleFunc("/users/rotate-key", xttyServer.HandleKeyRotation)
+	http.HandleFunc("/users/delete", xttyServer.HandleAccountDeletion)
 	http.HandleFunc("/status", xttyServer.HandleStatusCheck)
+	http.HandleFunc("/metrics", xttyServer.HandleMetrics)
+	http.HandleFunc("/rooms", xttyServer.HandleCreateRoom)
 
 	// Create a server with grateful shutdown
 	srv := &http.Server{
@@ -40,14 +64,40 @@ func main() {
 		Handler: nil, // use default serverMux
 	}
 
+	useTLS := *tlsCert != "" || *tlsKey != "" || *tlsSelfSigned
+	if useTLS {
+		tlsConfig, fingerprint, err := server.NewTLSConfig(server.TLSOptions{
+			CertFile:      *tlsCert,
+			KeyFile:       *tlsKey,
+			SelfSigned:    *tlsSelfSigned,
+			SelfSignedDir: *data,
+			Hosts:         []string{*host, "localhost", "127.0.0.1", "::1"},
+			ClientCAFile:  *tlsClientCA,
+		})
+		if err != nil {
+			log.Fatalf("Error setting up TLS: %v", err)
+		}
+		srv.TLSConfig = tlsConfig
+		log.Printf("TLS certificate fingerprint (SHA-256): %s", fingerprint)
+	} else if *tlsClientCA != "" {
+		log.Fatalf("-tls-client-ca needs TLS, give -tls-cert and -tls-key or -tls-self-signed")
+	}
+
 	// channel to listen for Interrupt signal
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
 
 	// Start the server in go routine
 	go func() {
-		log.Printf("Starting Xtty server on %s:%d", *host, *port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if useTLS {
+			log.Printf("Starting Xtty server on wss://%s:%d", *host, *port)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Starting Xtty server on %s:%d", *host, *port)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Error starting server %v", err)
 		}
 	}()
@@ -64,8 +114,19 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Error during server shutdown: %v", err)
 	}
+	xttyServer.Close()
 
 	// Wait for the server to finish processing requests
 	log.Println("Server gracefully stopped")
 
 }
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
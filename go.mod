@@ -3,9 +3,12 @@ module github.com/Theknighttron/Xtty
 go 1.23.4
 
 require (
+	filippo.io/edwards25519 v1.1.0
 	github.com/gdamore/tcell/v2 v2.8.1
 	github.com/gorilla/websocket v1.5.3
 	github.com/rivo/tview v0.0.0-20241227133733-17b7edb88c57
+	golang.org/x/crypto v0.32.0
+	golang.org/x/term v0.28.0
 )
 
 require (
@@ -14,6 +17,5 @@ require (
 	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/sys v0.29.0 // indirect
-	golang.org/x/term v0.28.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 )
@@ -1,21 +1,73 @@
 package client
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/Theknighttron/Xtty/internal/common"
+	"golang.org/x/crypto/scrypt"
 )
 
+// ConfigVersion is the current config file format. Version 0 configs kept the
+// private key as plain PEM; version 1 seals it with a passphrase.
+const ConfigVersion = 1
+
+// scrypt cost parameters for new passphrases
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrWrongPassphrase is returned when the private key can't be unsealed
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
 // Config for client configurations
 type Config struct {
+	Version    int    `json:"version"`
 	Username   string `json:"username"`
 	ServerHost string `json:"server_host"`
 	ServerPort int    `json:"server_port"`
-	PrivateKey []byte `json:"private_key"`
 	PublicKey  []byte `json:"public_key"`
+
+	// PrivateKey is the plain PEM key. It is only written to disk by version 0
+	// configs; newer ones store EncryptedPrivateKey and fill this in on Unlock.
+	PrivateKey          []byte     `json:"private_key,omitempty"`
+	EncryptedPrivateKey *SealedKey `json:"encrypted_private_key,omitempty"`
+
+	// Automatic key rotation. Zero uses the defaults, a negative value turns
+	// the trigger off.
+	RekeyAfterMessages int `json:"rekey_after_messages,omitempty"`
+	RekeyAfterMinutes  int `json:"rekey_after_minutes,omitempty"`
+
+	// Mean seconds between cover messages, 0 sends none
+	CoverTrafficSeconds int `json:"cover_traffic_seconds,omitempty"`
+
+	// TLS connects with wss://. The server's certificate is checked against
+	// TLSCAFile, or the system roots if that is empty, and must also match
+	// TLSFingerprint if one is set. A fingerprint alone is enough for servers
+	// with a self-signed certificate.
+	TLS            bool   `json:"tls,omitempty"`
+	TLSCAFile      string `json:"tls_ca_file,omitempty"`
+	TLSFingerprint string `json:"tls_fingerprint,omitempty"` // SHA-256, as printed by the server
+
+	// Client certificate for servers that require one
+	TLSCertFile string `json:"tls_cert_file,omitempty"`
+	TLSKeyFile  string `json:"tls_key_file,omitempty"`
+}
+
+// SealedKey is a private key encrypted with a passphrase derived AES-GCM key
+type SealedKey struct {
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Ciphertext []byte `json:"ciphertext"`
 }
 
 // Load the Config from the configurations file
@@ -54,6 +106,16 @@ func SaveConfig(config *Config, configPath string) error {
 		return err
 	}
 
+	// Never write the plain private key once it has been sealed
+	if config.Version >= ConfigVersion {
+		if config.EncryptedPrivateKey == nil {
+			return errors.New("refusing to save an unencrypted private key")
+		}
+		sealed := *config
+		sealed.PrivateKey = nil
+		config = &sealed
+	}
+
 	// Marshall config to JSON
 	data, err := json.MarshalIndent(config, "", " ")
 	if err != nil {
@@ -66,15 +128,18 @@ func SaveConfig(config *Config, configPath string) error {
 
 // Create a new configurations with a new key pairs
 func CreateNewConfig(username, serverHost string, serverPort int) (*Config, error) {
-	// Generate new keypair
-	privateKey, publicKey, err := common.GenerateKeyPair(2048)
+	// Generate new identity key, configs from before Ed25519 keep their RSA key
+	privateKey, err := common.GenerateSigningKey()
 	if err != nil {
 		return nil, err
 	}
 
 	// Encode keys to PEM
-	privateKeyPEM := common.EncodePrivateKeyToPEM(privateKey)
-	publicKeyPEM, err := common.EncodePublicKeyToPEM(publicKey)
+	privateKeyPEM, err := common.EncodeSigningKeyToPEM(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyPEM, err := common.EncodePublicKeyToPEM(privateKey.Public())
 	if err != nil {
 		return nil, err
 	}
@@ -91,6 +156,77 @@ func CreateNewConfig(username, serverHost string, serverPort int) (*Config, erro
 	return config, nil
 }
 
+// Lock seals the private key with a passphrase and upgrades the config to
+// the current version. The plain key stays available in memory.
+func (c *Config) Lock(passphrase []byte) error {
+	if c.PrivateKey == nil {
+		return errors.New("no private key to lock")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	sealed := &SealedKey{KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: salt}
+	key, err := sealed.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+
+	sealed.Ciphertext, err = common.SealAESGCM(key, c.PrivateKey, c.sealingAD())
+	if err != nil {
+		return err
+	}
+
+	c.EncryptedPrivateKey = sealed
+	c.Version = ConfigVersion
+	return nil
+}
+
+// Unlock decrypts the sealed private key
+func (c *Config) Unlock(passphrase []byte) error {
+	if c.EncryptedPrivateKey == nil {
+		return errors.New("private key is not encrypted")
+	}
+
+	key, err := c.EncryptedPrivateKey.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+
+	privateKey, err := common.OpenAESGCM(key, c.EncryptedPrivateKey.Ciphertext, c.sealingAD())
+	if err != nil {
+		return ErrWrongPassphrase
+	}
+
+	c.PrivateKey = privateKey
+	return nil
+}
+
+// IsLocked reports whether the private key still has to be unlocked
+func (c *Config) IsLocked() bool {
+	return c.PrivateKey == nil && c.EncryptedPrivateKey != nil
+}
+
+// NeedsMigration reports whether the config still stores its private key in plain text
+func (c *Config) NeedsMigration() bool {
+	return c.Version < ConfigVersion
+}
+
+// Binds the sealed key to the public key it belongs to
+func (c *Config) sealingAD() []byte {
+	return append([]byte("xtty config private key"), c.PublicKey...)
+}
+
+func (k *SealedKey) deriveKey(passphrase []byte) ([]byte, error) {
+	if k.KDF != "scrypt" {
+		return nil, errors.New("unsupported key derivation function: " + k.KDF)
+	}
+
+	return scrypt.Key(passphrase, k.Salt, k.N, k.R, k.P, 32)
+}
+
 // Return the default path for the config file
 func GetDefaultConfigPath() string {
 	homeDir, err := os.UserHomeDir()
@@ -100,3 +236,29 @@ func GetDefaultConfigPath() string {
 
 	return filepath.Join(homeDir, ".xtty", "config.json")
 }
+
+// RekeyPolicy returns the automatic key rotation settings
+func (c *Config) RekeyPolicy() RekeyPolicy {
+	policy := DefaultRekeyPolicy
+
+	switch {
+	case c.RekeyAfterMessages > 0:
+		policy.Messages = c.RekeyAfterMessages
+	case c.RekeyAfterMessages < 0:
+		policy.Messages = 0
+	}
+
+	switch {
+	case c.RekeyAfterMinutes > 0:
+		policy.Interval = time.Duration(c.RekeyAfterMinutes) * time.Minute
+	case c.RekeyAfterMinutes < 0:
+		policy.Interval = 0
+	}
+
+	return policy
+}
+
+// CoverTrafficInterval returns the mean time between cover messages, 0 when off
+func (c *Config) CoverTrafficInterval() time.Duration {
+	return time.Duration(max(c.CoverTrafficSeconds, 0)) * time.Second
+}
@@ -0,0 +1,128 @@
+package client_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/client"
+)
+
+func TestConfigLockUnlock(t *testing.T) {
+	config, err := client.CreateNewConfig("alice", "localhost", 8080)
+	if err != nil {
+		t.Fatalf("Failed to create config: %v", err)
+	}
+	privateKey := config.PrivateKey
+
+	// A fresh config is plain text and can't be saved until it's locked
+	path := filepath.Join(t.TempDir(), "config.json")
+	if !config.NeedsMigration() {
+		t.Errorf("New config should need migration before it is locked")
+	}
+
+	if err := config.Lock([]byte("correct horse")); err != nil {
+		t.Fatalf("Failed to lock config: %v", err)
+	}
+	if err := client.SaveConfig(config, path); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	loaded, err := client.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !loaded.IsLocked() {
+		t.Fatalf("Saved config should not contain the plain private key")
+	}
+
+	if err := loaded.Unlock([]byte("wrong horse")); !errors.Is(err, client.ErrWrongPassphrase) {
+		t.Errorf("Unlock with wrong passphrase returned %v, want ErrWrongPassphrase", err)
+	}
+
+	if err := loaded.Unlock([]byte("correct horse")); err != nil {
+		t.Fatalf("Failed to unlock config: %v", err)
+	}
+	if !bytes.Equal(loaded.PrivateKey, privateKey) {
+		t.Errorf("Unlocked private key doesn't match the original")
+	}
+}
+
+func TestConfigRefusesPlainSaveAfterLock(t *testing.T) {
+	config, err := client.CreateNewConfig("alice", "localhost", 8080)
+	if err != nil {
+		t.Fatalf("Failed to create config: %v", err)
+	}
+
+	// Claiming the current version without a sealed key must not leak the key
+	config.Version = client.ConfigVersion
+	if err := client.SaveConfig(config, filepath.Join(t.TempDir(), "config.json")); err == nil {
+		t.Errorf("Saving an unsealed version %d config should fail", client.ConfigVersion)
+	}
+}
+
+func TestConfigRekeyPolicy(t *testing.T) {
+	config := &client.Config{}
+	if policy := config.RekeyPolicy(); policy != client.DefaultRekeyPolicy {
+		t.Errorf("Empty config gave %+v, want the defaults", policy)
+	}
+
+	config.RekeyAfterMessages = 50
+	config.RekeyAfterMinutes = -1
+	policy := config.RekeyPolicy()
+	if policy.Messages != 50 || policy.Interval != 0 {
+		t.Errorf("Got %+v, want 50 messages and no time limit", policy)
+	}
+
+	config.RekeyAfterMessages = -1
+	config.RekeyAfterMinutes = 5
+	policy = config.RekeyPolicy()
+	if policy.Messages != 0 || policy.Interval != 5*time.Minute {
+		t.Errorf("Got %+v, want no message limit and 5 minutes", policy)
+	}
+}
+
+func TestConfigSetServer(t *testing.T) {
+	tests := []struct {
+		address string
+		url     string
+	}{
+		{"chat.example.com", "ws://chat.example.com:8080"},
+		{"chat.example.com:9000", "ws://chat.example.com:9000"},
+		{"wss://chat.example.com", "wss://chat.example.com:443"},
+		{"https://chat.example.com:8443/", "wss://chat.example.com:8443"},
+		{"ws://[::1]:8080", "ws://[::1]:8080"},
+	}
+	for _, test := range tests {
+		config := &client.Config{}
+		if err := config.SetServer(test.address); err != nil {
+			t.Errorf("SetServer(%q): %v", test.address, err)
+			continue
+		}
+		if got := config.ServerURL(); got != test.url {
+			t.Errorf("SetServer(%q) gave %s, want %s", test.address, got, test.url)
+		}
+	}
+
+	for _, address := range []string{"", "ftp://chat.example.com", "chat.example.com:http", ":8080"} {
+		if err := (&client.Config{}).SetServer(address); err == nil {
+			t.Errorf("SetServer(%q) should have failed", address)
+		}
+	}
+}
+
+func TestResolveServer(t *testing.T) {
+	config := &client.Config{ServerHost: "saved.example.com", ServerPort: 8080}
+
+	t.Setenv(client.ServerEnv, "env.example.com:9000")
+	if err := client.ResolveServer(config, ""); err != nil || config.ServerURL() != "ws://env.example.com:9000" {
+		t.Errorf("%s wasn't applied, got %s (%v)", client.ServerEnv, config.ServerURL(), err)
+	}
+
+	// The flag beats the environment
+	if err := client.ResolveServer(config, "wss://flag.example.com"); err != nil || config.ServerURL() != "wss://flag.example.com:443" {
+		t.Errorf("-server wasn't applied, got %s (%v)", config.ServerURL(), err)
+	}
+}
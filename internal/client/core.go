@@ -1,31 +1,67 @@
 package client
 
 import (
+	"crypto"
+	"crypto/ecdh"
 	"crypto/rand"
-	"crypto/rsa"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/big"
+	"sync"
 	"time"
 
+	"github.com/Theknighttron/Xtty/internal/common"
 	"github.com/gorilla/websocket"
 )
 
-const (
-	roomCodeLength = 6
-	letterBytes    = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // No confusing chars
-)
-
 type User struct {
 	Conn            *websocket.Conn
 	RoomCode        string
-	KeyPair         *rsa.PrivateKey
-	PeerPubKey      *rsa.PublicKey
-	Messages        []Message
-	Done            chan struct{}
-	KeyExchangeDone chan struct{}
+	KeyPair         *ecdh.PrivateKey // ephemeral X25519 handshake key
+	MemberID        string           // assigned by the server when we join the room
+	Done            chan struct{}    // closed once Cleanup has stopped the client
+	KeyExchangeDone chan struct{}    // closed once the first peer session is confirmed
 	Username        string
+
+	dialer          *websocket.Dialer // nil dials with websocket.DefaultDialer, either way offering common.Subprotocol
+	serverURL       string            // the server we last connected to, /join reuses it
+	resumeToken     string            // hands our room slot back to us after a reconnect
+	connected       bool              // welcomed on the current connection
+	running         bool              // the connection loop has started
+	switching       bool              // the live connection is being dropped for another room
+	reconnectTry    int               // reconnect attempts since the connection was lost
+	outbox          []string          // messages typed while the connection was down
+	roomOwner       string            // member ID of the room's owner
+	roomLocked      bool              // the room refuses new members
+	roomCapacity    int               // members the room holds, 0 for no limit
+	autoLocked      bool              // we locked the room once, and won't again
+	roomSize        int               // members a room we create may hold, 0 for the server's default
+	ownerTokens     map[string]string // room ID to the owner token of a room we created, until we join it
+	wordCodes       bool              // rooms we create get a channel number and word code
+	idle            bool              // turned away from the room, waiting for a /join
+	rejoin          chan struct{}     // wakes an idle connection loop for a /join
+	wake            chan struct{}     // cuts a reconnect's wait short for a /join
+	refusals        chan string       // why the room turned us away, for WaitForRoom
+	closing         chan struct{}     // closed by Cleanup
+	closeOnce       sync.Once
+	identity        crypto.Signer // long-term key from the config, signs key exchanges
+	signatureSuite  common.SuiteID
+	identityPEM     []byte
+	knownPeers      *KnownPeers
+	pake            *common.PAKE
+	sessions        map[string]*peerSession // confirmed sessions by member ID
+	pending         map[string]*handshake   // key exchanges awaiting confirmation
+	keyAlert        bool                    // a peer showed up with an unexpected identity key
+	replayGuard     *common.ReplayGuard
+	rekeyPolicy     RekeyPolicy
+	coverInterval   time.Duration // mean time between cover messages, 0 when off
+	coverChanged    chan struct{}
+	messages        []Message
+	mu              sync.Mutex // protects sessions, pending, keyAlert, rekeyPolicy, coverInterval, messages and the connection state
+	keyExchangeOnce sync.Once
+	writeMu         sync.Mutex // gorilla allows only one concurrent writer, also protects Conn
 }
 
 type Message struct {
@@ -33,15 +69,47 @@ type Message struct {
 	Timestamp time.Time `json:"timestamp"`
 	Sent      bool      `json:"sent"`
 	Sender    string    `json:"sender"`
+	System    bool      `json:"system,omitempty"`
+}
+
+// memberFrame is a membership event generated by the server
+type memberFrame struct {
+	Type    string `json:"type"`
+	Member  string `json:"member"`
+	Resume  string `json:"resume,omitempty"`  // welcome only, the token to resume our slot with
+	Resumed bool   `json:"resumed,omitempty"` // welcome only, we got our old slot back
+	Owner   string `json:"owner,omitempty"`   // welcome only, the room owner's member ID
+	Locked  bool   `json:"locked,omitempty"`  // welcome only
+	Members int    `json:"members,omitempty"` // welcome only, how many the room holds, 0 for no limit
+	Message string `json:"message,omitempty"` // room_error only
+}
+
+// chatFrame carries one ratcheted chat message for a single recipient
+type chatFrame struct {
+	Type    string               `json:"type"`
+	ID      string               `json:"id"`
+	From    string               `json:"from"`
+	Member  string               `json:"member"`
+	To      string               `json:"to"`
+	Epoch   uint32               `json:"epoch,omitempty"` // which key epoch the ratchet belongs to
+	Counter uint64               `json:"counter"`
+	Padded  bool                 `json:"padded,omitempty"` // content is a padded payload, see sealPayload
+	Header  common.RatchetHeader `json:"header"`
+	Content []byte               `json:"content"`
 }
 
-func GenerateRoomCode() string {
-	b := make([]byte, roomCodeLength)
-	for i := range b {
-		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(letterBytes))))
-		b[i] = letterBytes[n.Int64()]
+// Everything the ciphertext is bound to besides the ratchet header. Epoch
+// and Padded are sent in the clear, so the relay must not be able to change them.
+func (f chatFrame) associatedData(room string) common.AssociatedData {
+	return common.AssociatedData{
+		Room:      room,
+		Sender:    f.Member,
+		Recipient: f.To,
+		MessageID: f.ID,
+		Counter:   f.Counter,
+		Epoch:     f.Epoch,
+		Padded:    f.Padded,
 	}
-	return string(b)
 }
 
 func NewUser(username string) *User {
@@ -49,116 +117,258 @@ func NewUser(username string) *User {
 		Done:            make(chan struct{}),
 		KeyExchangeDone: make(chan struct{}),
 		Username:        username,
+		sessions:        make(map[string]*peerSession),
+		pending:         make(map[string]*handshake),
+		replayGuard:     common.NewReplayGuard(common.DefaultReplayWindow),
+		rekeyPolicy:     DefaultRekeyPolicy,
+		coverChanged:    make(chan struct{}, 1),
+		closing:         make(chan struct{}),
+		rejoin:          make(chan struct{}, 1),
+		wake:            make(chan struct{}, 1),
+		refusals:        make(chan string, 1),
+		ownerTokens:     make(map[string]string),
 	}
 }
 
+// JoinRoom connects to a room, leaving the current one if there is one
 func (c *User) JoinRoom(serverURL, roomCode string) error {
-	c.RoomCode = roomCode
+	c.mu.Lock()
+	running := c.running
+	c.mu.Unlock()
+
+	if running {
+		return c.switchRoom(serverURL, roomCode)
+	}
 	return c.Connect(serverURL, roomCode)
 }
 
+// SetDialer sets how the server is dialed, see Config.Dialer
+func (c *User) SetDialer(dialer *websocket.Dialer) {
+	c.dialer = dialer
+}
+
+// SetIdentity loads the long-term identity key from the config. Peers'
+// identity keys are checked against knownPeers when it isn't nil.
+func (c *User) SetIdentity(config *Config, knownPeers *KnownPeers) error {
+	privateKey, err := common.ParseSigningKeyFromPEM(config.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	c.signatureSuite, err = common.SignatureSuiteForKey(privateKey.Public())
+	if err != nil {
+		return err
+	}
+
+	c.identityPEM, err = common.EncodePublicKeyToPEM(privateKey.Public())
+	if err != nil {
+		return err
+	}
+
+	c.identity = privateKey
+	c.knownPeers = knownPeers
+	return nil
+}
+
+// GenerateKeyPair creates the ephemeral X25519 key used for this session's handshake
 func (c *User) GenerateKeyPair() error {
 	var err error
-	c.KeyPair, err = rsa.GenerateKey(rand.Reader, 2048)
+	c.KeyPair, err = ecdh.X25519().GenerateKey(rand.Reader)
 	return err
 }
 
+// Connect joins the room and keeps the connection up, reconnecting with
+// backoff whenever it drops
 func (c *User) Connect(serverURL, roomCode string) error {
-	conn, _, err := websocket.DefaultDialer.Dial(
-		fmt.Sprintf("%s/ws?room=%s", serverURL, roomCode),
-		nil,
-	)
+	_, password, err := SplitRoomCode(roomCode)
+	if err != nil {
+		return err
+	}
+
+	pake, err := common.NewPAKE([]byte(password))
 	if err != nil {
 		return err
 	}
-	c.Conn = conn
+
+	c.mu.Lock()
+	c.pake = pake
 	c.RoomCode = roomCode
+	c.serverURL = serverURL
+	c.resumeToken = ""
+	c.mu.Unlock()
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.running = true
+	c.mu.Unlock()
 
-	go c.readPump()
+	go c.run(conn)
+	go c.rekeyLoop()
+	go c.coverLoop()
 	return nil
 }
 
-func (c *User) readPump() {
-	defer close(c.Done)
-
-	// Send our public key immediately after connecting
-	if err := c.SendKeyExchange(); err != nil {
-		log.Printf("Failed to send key exchange: %v, err")
-		return
-	}
+// relayEvents are the frame types only the relay sends, it sends them as text
+// messages and passes frames from peers on as binary ones
+var relayEvents = map[string]bool{
+	"welcome":       true,
+	"member_joined": true,
+	"member_left":   true,
+	"owner":         true,
+	"room_locked":   true,
+	"room_unlocked": true,
+	"room_error":    true,
+}
 
+// Reads frames until the connection fails
+func (c *User) readPump(conn *websocket.Conn) error {
+	first := true
 	for {
-		_, msg, err := c.Conn.ReadMessage()
+		messageType, msg, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("Read error: %v", err)
-			return
+			return err
 		}
+		welcome := first
+		first = false
 
 		// Handle different message types
-		var data map[string]interface{}
-		if err := json.Unmarshal(msg, &data); err != nil {
+		var frame struct {
+			Type string `json:"type"`
+			To   string `json:"to"`
+		}
+		if err := json.Unmarshal(msg, &frame); err != nil {
 			log.Printf("Invalid message format: %v", err)
 			continue
 		}
 
-		switch data["type"] {
+		// The relay fans every frame out to the whole room
+		c.mu.Lock()
+		memberID := c.MemberID
+		c.mu.Unlock()
+		if frame.To != "" && frame.To != memberID {
+			continue
+		}
+
+		// The relay's welcome is the first frame on a connection, a later
+		// one is a peer trying to reset our sessions
+		if (frame.Type == "welcome") != welcome {
+			continue
+		}
+		// Nor may a peer tell us who owns the room or whether it is locked
+		if relayEvents[frame.Type] && messageType != websocket.TextMessage {
+			continue
+		}
+
+		switch frame.Type {
+		case "welcome":
+			c.handleWelcome(msg)
+		case "member_left":
+			c.handleMemberLeft(msg)
+		case "owner":
+			c.handleOwner(msg)
+		case "room_locked":
+			c.handleRoomLock(true)
+		case "room_unlocked":
+			c.handleRoomLock(false)
+		case "room_error":
+			c.handleRoomError(msg)
 		case "key_exchange":
-			c.handleKeyExchange(data)
-			close(c.KeyExchangeDone)
+			c.handleKeyExchange(msg)
+		case "key_confirm":
+			c.handleKeyConfirm(msg)
+		case "rekey":
+			c.handleRekey(msg)
 		case "message":
-			if c.PeerPubKey == nil {
-				log.Println("Received message before key exchange")
-				continue
-			}
-			c.handleEncryptedMessage(data)
+			c.handleEncryptedMessage(msg)
 		}
 	}
 }
 
-func (c *User) SendKeyExchange() error {
-	if c.KeyPair == nil {
-		return fmt.Errorf("no key pair generated")
+// The server tells us our member ID, after which we can announce our key.
+// After a reconnect it may instead hand our old slot back, and the sessions
+// we had carry on.
+func (c *User) handleWelcome(msg []byte) {
+	var frame memberFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		log.Println("Invalid welcome format")
+		return
 	}
 
-	pubKeyBytes, err := json.Marshal(c.KeyPair.PublicKey)
-	if err != nil {
-		return err
+	c.mu.Lock()
+	c.resumeToken = frame.Resume
+	c.connected = true
+	delete(c.ownerTokens, c.roomID())
+	c.reconnectTry = 0
+	c.roomOwner = frame.Owner
+	c.roomLocked = frame.Locked
+	c.roomCapacity = frame.Members
+
+	if frame.Resumed && frame.Member == c.MemberID {
+		c.notify("Reconnected, session resumed")
+		c.flushOutbox()
+		c.mu.Unlock()
+		return
 	}
 
-	msg := map[string]interface{}{
-		"type": "key_exchange",
-		"key":  string(pubKeyBytes),
+	// Our old slot expired and the peers dropped our sessions, start over
+	if c.MemberID != "" {
+		c.sessions = make(map[string]*peerSession)
+		c.pending = make(map[string]*handshake)
+		if err := c.freshHandshakeKeys(); err != nil {
+			log.Printf("Failed to make new handshake keys: %v", err)
+		}
+		c.notify("Reconnected as a new member, exchanging keys again")
 	}
+	c.MemberID = frame.Member
 
-	return c.Conn.WriteJSON(msg)
+	if err := c.SendKeyExchange("", false); err != nil {
+		log.Printf("Failed to send key exchange: %v", err)
+	}
+	c.mu.Unlock()
 }
 
-func (c *User) handleKeyExchange(data map[string]interface{}) {
-	keyStr, ok := data["key"].(string)
-	if !ok {
-		log.Println("Invalid key format")
-		return
+// Serializes writes from the read pump and the UI onto the connection
+func (c *User) writeJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.Conn == nil {
+		return errors.New("not connected")
 	}
+	return c.Conn.WriteJSON(v)
+}
 
-	var pubKey rsa.PublicKey
-	if err := json.Unmarshal([]byte(keyStr), &pubKey); err != nil {
-		log.Printf("Failed to parse public key: %v", err)
-		return
-	}
+// Shows a system notice in the chat window, c.mu must be held
+func (c *User) notify(text string) {
+	log.Println(text)
+	c.messages = append(c.messages, Message{
+		Content:   text,
+		Timestamp: time.Now(),
+		System:    true,
+	})
+}
 
-	c.PeerPubKey = &pubKey
-	log.Println("Peer public key received and verified")
+// TakeMessages returns the messages received since the last call
+func (c *User) TakeMessages() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Send confirmation message
-	confirmation := map[string]interface{}{
-		"type": "key_confirm",
-		"from": c.Username,
-	}
-	c.Conn.WriteJSON(confirmation)
+	messages := c.messages
+	c.messages = nil
+	return messages
 }
 
+// SendMessage encrypts the message separately for every confirmed peer. While
+// the connection is down it is held in the outbox instead.
 func (c *User) SendMessage(content string) error {
-	if c.PeerPubKey == nil {
+	c.mu.Lock()
+	waiting := c.connected && len(c.sessions) == 0 && !c.keysExchanged()
+	c.mu.Unlock()
+
+	if waiting {
 		select {
 		case <-c.KeyExchangeDone:
 			// Keys exchanged, continue
@@ -167,58 +377,190 @@ func (c *User) SendMessage(content string) error {
 		}
 	}
 
-	encrypted, err := rsa.EncryptPKCS1v15(
-		rand.Reader,
-		c.PeerPubKey,
-		[]byte(content),
-	)
-	if err != nil {
-		return err
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Down, or exchanging keys again after a reconnect
+	if !c.connected || len(c.sessions) == 0 && c.keysExchanged() {
+		return c.hold(content)
+	}
+
+	if len(c.sessions) == 0 {
+		return fmt.Errorf("no peers in the room")
 	}
 
-	msg := map[string]interface{}{
-		"type":    "message",
-		"content": encrypted,
+	if err := c.sendChat(content); err != nil {
+		return err
 	}
 
-	c.Messages = append(c.Messages, Message{
+	c.messages = append(c.messages, Message{
 		Content:   content,
 		Timestamp: time.Now(),
 		Sent:      true,
 	})
 
-	return c.Conn.WriteJSON(msg)
+	return nil
 }
 
-func (c *User) handleEncryptedMessage(data map[string]interface{}) {
-	encrypted, ok := data["content"].(string)
-	if !ok {
+// Encrypts a chat message for every confirmed peer, c.mu must be held
+func (c *User) sendChat(content string) error {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	for member, session := range c.sessions {
+		if err := c.sendPayload(member, session, hex.EncodeToString(id), payloadChat, []byte(content)); err != nil {
+			return err
+		}
+
+		session.epochMessages++
+		c.maybeRekey(session)
+	}
+
+	c.maybeAutoLock()
+	return nil
+}
+
+// Reports whether a session was ever confirmed
+func (c *User) keysExchanged() bool {
+	select {
+	case <-c.KeyExchangeDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// Encrypts one payload for one peer, c.mu must be held
+func (c *User) sendPayload(member string, session *peerSession, id string, kind byte, content []byte) error {
+	session.sendCounter++
+	msg := chatFrame{
+		Type:    "message",
+		ID:      id,
+		From:    c.Username,
+		Member:  c.MemberID,
+		To:      member,
+		Epoch:   session.Epoch,
+		Counter: session.sendCounter,
+	}
+
+	plaintext := content
+	if session.canPad {
+		msg.Padded = true
+		plaintext = sealPayload(kind, content)
+	}
+
+	var err error
+	ad := msg.associatedData(c.roomID())
+	msg.Header, msg.Content, err = session.ratchet.Encrypt(plaintext, ad.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return c.writeJSON(msg)
+}
+
+func (c *User) handleEncryptedMessage(msg []byte) {
+	var frame chatFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
 		log.Println("Invalid message format")
 		return
 	}
 
-	decrypted, err := rsa.DecryptPKCS1v15(
-		rand.Reader,
-		c.KeyPair,
-		[]byte(encrypted),
-	)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session, ok := c.sessions[frame.Member]
+	if !ok {
+		log.Println("Received message before key exchange")
+		return
+	}
+
+	ad := frame.associatedData(c.roomID())
+	if err := c.replayGuard.Check(ad); err != nil {
+		c.notify(fmt.Sprintf("Dropped a message claiming to be from %s: %v", session.Username, err))
+		return
+	}
+
+	ratchet := session.ratchet
+	switch {
+	case frame.Epoch == session.Epoch:
+	case frame.Epoch+1 == session.Epoch && session.previous != nil:
+		ratchet = session.previous
+	default:
+		log.Printf("Message from %s for key epoch %d, at epoch %d", session.Username, frame.Epoch, session.Epoch)
+		return
+	}
+
+	decrypted, err := ratchet.Decrypt(frame.Header, frame.Content, ad.Bytes())
+	if errors.Is(err, common.ErrReplayedMessage) {
+		c.notify(fmt.Sprintf("Dropped a replayed message claiming to be from %s", session.Username))
+		return
+	}
 	if err != nil {
 		log.Printf("Decryption failed: %v", err)
 		return
 	}
 
-	c.Messages = append(c.Messages, Message{
+	// Only authenticated messages may advance the replay window
+	if err := c.replayGuard.Accept(ad); err != nil {
+		c.notify(fmt.Sprintf("Dropped a message claiming to be from %s: %v", session.Username, err))
+		return
+	}
+
+	// The peer has moved to the current epoch, nothing more will arrive under the old one
+	if ratchet == session.ratchet {
+		session.previous = nil
+	}
+
+	if frame.Padded {
+		var kind byte
+		kind, decrypted, err = openPayload(decrypted)
+		if err != nil {
+			log.Printf("Invalid payload from %s: %v", session.Username, err)
+			return
+		}
+		if kind == payloadCover {
+			return
+		}
+	}
+
+	session.epochMessages++
+	c.maybeRekey(session)
+	c.maybeAutoLock()
+
+	c.messages = append(c.messages, Message{
 		Content:   string(decrypted),
 		Timestamp: time.Now(),
 		Sent:      false,
+		Sender:    session.Username,
 	})
 }
 
+// The routing part of the room code, what the server knows the room as
+func (c *User) roomID() string {
+	roomID, _, _ := SplitRoomCode(c.RoomCode)
+	return roomID
+}
+
+// Cleanup leaves the room and stops reconnecting
 func (c *User) Cleanup() {
+	c.closeOnce.Do(func() { close(c.closing) })
+
+	// Saying goodbye frees our slot at once instead of holding it for a resume
+	c.writeMu.Lock()
 	if c.Conn != nil {
+		c.Conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
 		c.Conn.Close()
 	}
+	c.writeMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.KeyPair = nil
-	c.PeerPubKey = nil
-	c.Messages = nil
+	c.sessions = make(map[string]*peerSession)
+	c.pending = make(map[string]*handshake)
+	c.keyAlert = false
+	c.messages = nil
 }
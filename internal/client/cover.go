@@ -0,0 +1,105 @@
+package client
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+// Chat payloads are padded to common.PaddedLength buckets before they are
+// encrypted, so the relay only learns a coarse size. The first byte says
+// what the payload is: cover messages look like chat on the wire and are
+// dropped by the recipient after decryption.
+const (
+	payloadCover byte = 0
+	payloadChat  byte = 1
+)
+
+func sealPayload(kind byte, content []byte) []byte {
+	return common.Pad(append([]byte{kind}, content...))
+}
+
+func openPayload(padded []byte) (byte, []byte, error) {
+	payload, err := common.Unpad(padded)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) == 0 {
+		return 0, nil, errors.New("empty payload")
+	}
+	return payload[0], payload[1:], nil
+}
+
+// SetCoverTraffic sends dummy messages to every peer at random times
+// averaging interval apart, so the relay can't tell when anyone is typing.
+// Zero turns cover traffic off.
+func (c *User) SetCoverTraffic(interval time.Duration) {
+	c.mu.Lock()
+	c.coverInterval = interval
+	c.mu.Unlock()
+
+	// Wake the loop so a new rate applies straight away
+	select {
+	case c.coverChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (c *User) coverLoop() {
+	for {
+		c.mu.Lock()
+		interval := c.coverInterval
+		c.mu.Unlock()
+
+		if interval <= 0 {
+			select {
+			case <-c.Done:
+				return
+			case <-c.coverChanged:
+				continue
+			}
+		}
+
+		// Exponential gaps make the cover a Poisson process, with no rhythm to spot
+		timer := time.NewTimer(time.Duration(rand.ExpFloat64() * float64(interval)))
+		select {
+		case <-c.Done:
+			timer.Stop()
+			return
+		case <-c.coverChanged:
+			timer.Stop()
+			continue
+		case <-timer.C:
+			c.sendCover()
+		}
+	}
+}
+
+func (c *User) sendCover() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.connected {
+		return
+	}
+
+	id := make([]byte, 8)
+	if _, err := cryptorand.Read(id); err != nil {
+		return
+	}
+
+	for member, session := range c.sessions {
+		if !session.canPad {
+			continue
+		}
+		if err := c.sendPayload(member, session, hex.EncodeToString(id), payloadCover, nil); err != nil {
+			log.Printf("Failed to send cover traffic: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// KeepaliveInterval is how often the client pings the server
+	KeepaliveInterval = 30 * time.Second
+	// KeepaliveTimeout is how long the server may stay silent, neither
+	// answering our pings nor sending its own, before it is considered dead
+	KeepaliveTimeout = 2 * KeepaliveInterval
+
+	controlWriteTimeout = 5 * time.Second
+)
+
+// keepAlive starts pinging the server until done is closed. Pings and pongs
+// from the server push the read deadline back, so a dead server or a
+// half-open connection makes the pending read fail within KeepaliveTimeout.
+// Call it before the connection's read loop starts.
+func keepAlive(conn *websocket.Conn, done <-chan struct{}) {
+	alive := func() {
+		conn.SetReadDeadline(time.Now().Add(KeepaliveTimeout))
+	}
+
+	alive()
+	conn.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		alive()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(controlWriteTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	go func() {
+		ticker := time.NewTicker(KeepaliveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// WriteControl is safe alongside the connection's other writers
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(controlWriteTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
@@ -9,23 +9,63 @@ import (
 // RunClient handles the complete client lifecycle
 func RunClient() error {
 	// Define command line flags
-	joinCode := flag.String("join", "", "Room code to join")
-	username := flag.String("username", "", "Your username")
+	joinCode := flag.String("join", "", "Room code to join (ROOM-PASSWORD or CHANNEL-WORDS)")
+	members := flag.Int("members", 0, "How many people a room you create may hold (default 2)")
+	words := flag.Bool("words", false, "Give a room you create a code of a number and words, easier to read out")
+	username := flag.String("username", "", "Your username (default from the config)")
+	configPath := flag.String("config", GetDefaultConfigPath(), "Config file")
+	server := flag.String("server", "", "Server as host:port or a ws:// or wss:// URL (default $"+ServerEnv+", then the config)")
 	flag.Parse()
 
-	// Validate username
+	// A mistyped code is caught before anything else happens
+	if *joinCode != "" {
+		if _, _, err := SplitRoomCode(*joinCode); err != nil {
+			return err
+		}
+	}
+
+	// Load the long-term identity, set up on first run
+	config, err := OpenConfig(*configPath, *username, ServerOverride(*server))
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if err := ResolveServer(config, *server); err != nil {
+		return err
+	}
 	if *username == "" {
-		return fmt.Errorf("username is required (use -username YOURNAME)")
+		*username = config.Username
+	}
+
+	knownPeers, err := LoadKnownPeers(GetDefaultKnownPeersPath())
+	if err != nil {
+		return fmt.Errorf("failed to load known peers: %v", err)
 	}
 
 	// Initialize client
 	c := NewUser(*username)
 	defer c.Cleanup()
 
+	if err := c.SetIdentity(config, knownPeers); err != nil {
+		return err
+	}
+	c.SetRekeyPolicy(config.RekeyPolicy())
+	c.SetCoverTraffic(config.CoverTrafficInterval())
+	c.SetRoomSize(*members)
+	c.SetWordCodes(*words)
+
+	dialer, err := config.Dialer()
+	if err != nil {
+		return fmt.Errorf("failed to set up TLS: %v", err)
+	}
+	c.SetDialer(dialer)
+
 	var roomCode string
 	if *joinCode == "" {
 		// Create new room
-		roomCode = GenerateRoomCode()
+		roomCode, err = c.CreateRoom(config.ServerURL())
+		if err != nil {
+			return fmt.Errorf("failed to create a room: %v", err)
+		}
 		fmt.Printf("Your room code: %s\n", roomCode)
 		fmt.Println("Share this with your peer to connect")
 	} else {
@@ -40,8 +80,7 @@ func RunClient() error {
 	}
 
 	// Connect to server
-	serverURL := "ws://localhost:8080"
-	if err := c.Connect(serverURL, roomCode); err != nil {
+	if err := c.Connect(config.ServerURL(), roomCode); err != nil {
 		return fmt.Errorf("connection failed: %v", err)
 	}
 
@@ -50,6 +89,8 @@ func RunClient() error {
 		select {
 		case <-c.KeyExchangeDone:
 			// Key exchange completed
+		case reason := <-c.refusals:
+			return fmt.Errorf("could not join the room: %s", reason)
 		case <-time.After(10 * time.Second):
 			return fmt.Errorf("timed out waiting for peer")
 		}
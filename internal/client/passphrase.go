@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const unlockAttempts = 3
+
+// Shared so buffered input isn't lost between prompts when stdin is piped
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// OpenConfig loads the config and unlocks its private key, prompting on the
+// terminal. A missing config is set up by a first-run wizard that offers
+// username and server as defaults, and a plain text one is migrated to a
+// passphrase-sealed key.
+func OpenConfig(configPath, username, server string) (*Config, error) {
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		return runSetupWizard(configPath, username, server)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.NeedsMigration() {
+		fmt.Println("Your private key is stored unencrypted, choose a passphrase to protect it")
+		if err := lockAndSave(config, configPath); err != nil {
+			return nil, err
+		}
+
+		return config, nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		passphrase, err := readPassphrase("Passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+
+		err = config.Unlock(passphrase)
+		if err == nil {
+			return config, nil
+		}
+		if !errors.Is(err, ErrWrongPassphrase) || attempt == unlockAttempts {
+			return nil, err
+		}
+
+		fmt.Println("Wrong passphrase, try again")
+	}
+}
+
+// ChangePassphrase re-seals the private key in the config under a new passphrase
+func ChangePassphrase(configPath string) error {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	if !config.NeedsMigration() {
+		passphrase, err := readPassphrase("Current passphrase: ")
+		if err != nil {
+			return err
+		}
+
+		if err := config.Unlock(passphrase); err != nil {
+			return err
+		}
+	}
+
+	return lockAndSave(config, configPath)
+}
+
+// Asks for the username and server, then creates and saves a new config
+func runSetupWizard(configPath, username, server string) (*Config, error) {
+	fmt.Printf("No config at %s, let's set one up\n", configPath)
+
+	username, err := readLine("Username", username)
+	if err != nil {
+		return nil, err
+	}
+	if username == "" {
+		return nil, errors.New("username is required")
+	}
+
+	if server == "" {
+		server = DefaultServer
+	}
+	server, err = readLine("Server", server)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := CreateNewConfig(username, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.SetServer(server); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Creating a new identity key, choose a passphrase to protect it")
+	if err := lockAndSave(config, configPath); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Saved config to %s\n", configPath)
+	return config, nil
+}
+
+// Reads a line, returning fallback when it is empty
+func readLine(prompt, fallback string) (string, error) {
+	if fallback != "" {
+		fmt.Printf("%s [%s]: ", prompt, fallback)
+	} else {
+		fmt.Printf("%s: ", prompt)
+	}
+
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	if line = strings.TrimSpace(line); line == "" {
+		return fallback, nil
+	}
+	return line, nil
+}
+
+func lockAndSave(config *Config, configPath string) error {
+	passphrase, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+
+	if err := config.Lock(passphrase); err != nil {
+		return err
+	}
+
+	return SaveConfig(config, configPath)
+}
+
+// Asks for a new passphrase twice
+func readNewPassphrase() ([]byte, error) {
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase must not be empty")
+	}
+
+	confirm, err := readPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, confirm) {
+		return nil, errors.New("passphrases do not match")
+	}
+
+	return passphrase, nil
+}
+
+// Reads a passphrase without echo, or a plain line when stdin isn't a terminal
+func readPassphrase(prompt string) ([]byte, error) {
+	fmt.Print(prompt)
+	defer fmt.Println()
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		return term.ReadPassword(fd)
+	}
+
+	line, err := stdinReader.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, err
+	}
+
+	return bytes.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,312 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Reconnect delays double from reconnectBaseDelay up to reconnectMaxDelay,
+	// each one randomized so clients dropped together don't return together
+	reconnectBaseDelay = 500 * time.Millisecond
+	reconnectMaxDelay  = 30 * time.Second
+
+	// maxOutbox is how many messages are held while the connection is down
+	maxOutbox = 100
+)
+
+// Dials the room, asking for our old slot back if we have a resume token
+func (c *User) dial() (*websocket.Conn, error) {
+	c.mu.Lock()
+	// The server only ever sees the routing part of the code
+	roomID := c.roomID()
+	target := fmt.Sprintf("%s/ws?room=%s", c.serverURL, url.QueryEscape(roomID))
+	if c.resumeToken != "" {
+		target += "&resume=" + url.QueryEscape(c.resumeToken)
+	} else if token := c.ownerTokens[c.roomID()]; token != "" {
+		target += "&owner=" + url.QueryEscape(token)
+	}
+	c.mu.Unlock()
+
+	dialer := *websocket.DefaultDialer
+	if c.dialer != nil {
+		dialer = *c.dialer
+	}
+	dialer.Subprotocols = []string{common.Subprotocol}
+
+	conn, _, err := dialer.Dial(target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	// Cleanup ran while we were dialing and closed the old connection instead
+	if c.isClosing() {
+		conn.Close()
+		return nil, errors.New("client is closed")
+	}
+	// A /join picked another room while we were dialing this one
+	if c.roomID() != roomID {
+		conn.Close()
+		return nil, errors.New("switched rooms while dialing")
+	}
+	c.Conn = conn
+	return conn, nil
+}
+
+// Keeps a connection going until Cleanup: reads it until it drops, then
+// reconnects and reads the new one. When the room turns us away for good it
+// waits for a /join instead.
+func (c *User) run(conn *websocket.Conn) {
+	defer close(c.Done)
+
+	for conn != nil {
+		connDone := make(chan struct{})
+		keepAlive(conn, connDone)
+		err := c.readPump(conn)
+		close(connDone)
+		conn.Close()
+
+		c.mu.Lock()
+		// Not live any more, switchRoom has nothing to close
+		c.writeMu.Lock()
+		if c.Conn == conn {
+			c.Conn = nil
+		}
+		c.writeMu.Unlock()
+		c.connected = false
+		switching := c.switching
+		c.switching = false
+		reason, refused := roomRefusal(err)
+		refused = refused && !switching
+		switch {
+		case switching || c.isClosing():
+		case refused:
+			c.notify(fmt.Sprintf("Left the room: %s. Use /join or /new to enter another one", reason))
+			c.resetRoom()
+			c.idle = true
+		default:
+			c.notify(lostConnectionNotice(err))
+		}
+		c.mu.Unlock()
+
+		if refused {
+			select {
+			case c.refusals <- reason:
+			default:
+			}
+			conn = c.waitForJoin()
+		} else {
+			conn = c.reconnect(switching)
+		}
+	}
+}
+
+// Sits out until switchRoom picks a new room, or Cleanup
+func (c *User) waitForJoin() *websocket.Conn {
+	select {
+	case <-c.closing:
+		return nil
+	case <-c.rejoin:
+		return c.reconnect(true)
+	}
+}
+
+func lostConnectionNotice(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Sprintf("Lost connection to the server, no response for %s. Reconnecting...", KeepaliveTimeout)
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Text == common.RoomRefusedNoOwner {
+		return "The room's creator hasn't joined yet. Trying again..."
+	}
+	return fmt.Sprintf("Disconnected from the server (%v). Reconnecting...", err)
+}
+
+// Dials until it works, waiting longer after each failure. Returns nil once
+// Cleanup is called.
+func (c *User) reconnect(immediate bool) *websocket.Conn {
+	for attempt := 1; ; attempt++ {
+		c.mu.Lock()
+		c.reconnectTry = attempt
+		c.mu.Unlock()
+
+		delay := reconnectDelay(attempt)
+		if immediate && attempt == 1 {
+			delay = 0
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-c.closing:
+			timer.Stop()
+			return nil
+		case <-c.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		conn, err := c.dial()
+		if err == nil {
+			// A /join that came while this dial was under way is answered by it
+			select {
+			case <-c.wake:
+			default:
+			}
+			return conn
+		}
+		log.Printf("Reconnect attempt %d failed: %v", attempt, err)
+	}
+}
+
+// Exponential backoff with equal jitter: half the delay is fixed, half random
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if shift := attempt - 1; shift < 16 {
+		delay = min(reconnectBaseDelay<<shift, reconnectMaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func (c *User) isClosing() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Leaves the current room for another, c.run dials it once the old
+// connection is closed
+func (c *User) switchRoom(serverURL, roomCode string) error {
+	if _, _, err := SplitRoomCode(roomCode); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.RoomCode = roomCode
+	c.serverURL = serverURL
+	c.resetRoom()
+	idle := c.idle
+	c.idle = false
+	if err := c.freshHandshakeKeys(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	// Only the end of a live connection tells the loop we switched. Without
+	// one the loop is waiting to reconnect, and dials the new room instead.
+	c.writeMu.Lock()
+	conn := c.Conn
+	c.switching = !idle && conn != nil
+	if !idle && conn == nil {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+	c.writeMu.Unlock()
+	c.mu.Unlock()
+
+	// Nothing to close, the loop is waiting for us
+	if idle {
+		c.rejoin <- struct{}{}
+		return nil
+	}
+	if conn == nil {
+		return nil
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.Conn == conn {
+		c.Conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		c.Conn.Close()
+	}
+	return nil
+}
+
+// New handshake and PAKE keys, so no ratchet ever starts from a root key
+// used before. c.mu must be held.
+func (c *User) freshHandshakeKeys() error {
+	_, password, err := SplitRoomCode(c.RoomCode)
+	if err != nil {
+		return err
+	}
+
+	pake, err := common.NewPAKE([]byte(password))
+	if err != nil {
+		return err
+	}
+	if err := c.GenerateKeyPair(); err != nil {
+		return err
+	}
+
+	c.pake = pake
+	return nil
+}
+
+// Keeps a message for when the connection is back, c.mu must be held
+func (c *User) hold(content string) error {
+	if len(c.outbox) >= maxOutbox {
+		return fmt.Errorf("not connected, and %d messages are already waiting", maxOutbox)
+	}
+
+	if len(c.outbox) == 0 {
+		c.notify("Not connected, messages will be sent once the connection is back")
+	}
+	c.outbox = append(c.outbox, content)
+	c.messages = append(c.messages, Message{
+		Content:   content,
+		Timestamp: time.Now(),
+		Sent:      true,
+	})
+	return nil
+}
+
+// Sends the held messages once there is someone to send them to, c.mu must be held
+func (c *User) flushOutbox() {
+	if !c.connected || len(c.sessions) == 0 {
+		return
+	}
+
+	for len(c.outbox) > 0 {
+		if err := c.sendChat(c.outbox[0]); err != nil {
+			log.Printf("Failed to send held message: %v", err)
+			return
+		}
+		c.outbox = c.outbox[1:]
+	}
+}
+
+// Connected reports whether we are in the room right now
+func (c *User) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// ReconnectAttempt is the number of the reconnect attempt in progress, 0
+// while connected
+func (c *User) ReconnectAttempt() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connected {
+		return 0
+	}
+	return c.reconnectTry
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+// A rekey replaces a pairwise session's ratchet with one rooted in a fresh
+// X25519 exchange mixed with a secret carried over from the previous epoch,
+// so the new keys are as strong as both. The exchange runs over the room
+// connection while the conversation continues: the ratchet of the previous
+// epoch is kept until the peer is seen using the new one.
+
+const (
+	// DefaultRekeyAfterMessages is how many messages a session carries before its keys rotate
+	DefaultRekeyAfterMessages = 1000
+	// DefaultRekeyAfter is how long a session keeps its keys before they rotate
+	DefaultRekeyAfter = time.Hour
+
+	rekeyCheckInterval = 30 * time.Second
+	rekeyTimeout       = 30 * time.Second // a rekey not answered by then may be restarted
+)
+
+var (
+	rekeySecretInfo = []byte("xtty rekey secret")
+	rekeyRootInfo   = []byte("xtty rekey")
+)
+
+// RekeyPolicy decides when sessions rotate their keys automatically. A zero
+// field disables that trigger.
+type RekeyPolicy struct {
+	Messages int
+	Interval time.Duration
+}
+
+// DefaultRekeyPolicy is used until SetRekeyPolicy is called
+var DefaultRekeyPolicy = RekeyPolicy{
+	Messages: DefaultRekeyAfterMessages,
+	Interval: DefaultRekeyAfter,
+}
+
+// rekeyFrame proposes, or with Reply answers, the keys of the next epoch
+type rekeyFrame struct {
+	Type      string `json:"type"`
+	From      string `json:"from"`
+	Member    string `json:"member"`
+	To        string `json:"to"`
+	Epoch     uint32 `json:"epoch"`
+	Key       []byte `json:"key"`
+	Reply     bool   `json:"reply,omitempty"`
+	Signature []byte `json:"signature"`
+}
+
+// The bytes covered by a rekey signature
+func (f rekeyFrame) signedPayload() []byte {
+	payload, _ := json.Marshal([]interface{}{"xtty rekey", f.From, f.Member, f.To, f.Epoch, f.Key, f.Reply})
+	return payload
+}
+
+// SetRekeyPolicy changes when sessions rotate their keys automatically
+func (c *User) SetRekeyPolicy(policy RekeyPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rekeyPolicy = policy
+}
+
+// Rekey starts a key rotation with the named peer, or with every peer when
+// username is empty
+func (c *User) Rekey(username string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	started := 0
+	for _, session := range c.sessions {
+		if username != "" && session.Username != username {
+			continue
+		}
+		if !session.canRekey {
+			if username != "" {
+				return fmt.Errorf("%s's client doesn't support rekeying", session.Username)
+			}
+			continue
+		}
+
+		if err := c.startRekey(session); err != nil {
+			return err
+		}
+		started++
+	}
+
+	if started == 0 {
+		if username != "" {
+			return errors.New("no such peer")
+		}
+		return errors.New("no peer to rekey with")
+	}
+	return nil
+}
+
+// Sends our key for the session's next epoch, c.mu must be held
+func (c *User) startRekey(session *peerSession) error {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	if err := c.sendRekey(session, session.Epoch+1, key, false); err != nil {
+		return err
+	}
+
+	session.rekeyKey = key
+	session.rekeyStarted = time.Now()
+	return nil
+}
+
+func (c *User) sendRekey(session *peerSession, epoch uint32, key *ecdh.PrivateKey, reply bool) error {
+	frame := rekeyFrame{
+		Type:   "rekey",
+		From:   c.Username,
+		Member: c.MemberID,
+		To:     session.MemberID,
+		Epoch:  epoch,
+		Key:    key.PublicKey().Bytes(),
+		Reply:  reply,
+	}
+
+	signer, err := common.LookupSignatureSuite(c.signatureSuite)
+	if err != nil {
+		return err
+	}
+
+	frame.Signature, err = signer.Sign(c.identity, frame.signedPayload())
+	if err != nil {
+		return err
+	}
+
+	return c.writeJSON(frame)
+}
+
+// Counts a message against the policy and rotates the session's keys when
+// it's due, c.mu must be held
+func (c *User) maybeRekey(session *peerSession) {
+	if !session.canRekey || !c.connected {
+		return
+	}
+	if session.rekeyKey != nil && time.Since(session.rekeyStarted) < rekeyTimeout {
+		return
+	}
+
+	policy := c.rekeyPolicy
+	due := policy.Messages > 0 && session.epochMessages >= policy.Messages
+	due = due || policy.Interval > 0 && time.Since(session.epochStarted) >= policy.Interval
+	if !due {
+		return
+	}
+
+	if err := c.startRekey(session); err != nil {
+		log.Printf("Failed to rekey with %s: %v", session.Username, err)
+	}
+}
+
+// Applies the time based policy to sessions nobody is talking on
+func (c *User) rekeyLoop() {
+	ticker := time.NewTicker(rekeyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			for _, session := range c.sessions {
+				c.maybeRekey(session)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *User) handleRekey(msg []byte) {
+	var frame rekeyFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		log.Println("Invalid rekey format")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session, ok := c.sessions[frame.Member]
+	if !ok || !session.canRekey {
+		return
+	}
+
+	verifier, err := common.LookupSignatureSuite(session.signatureSuite)
+	if err != nil {
+		return
+	}
+	if err := verifier.Verify(session.identityKey, frame.signedPayload(), frame.Signature); err != nil {
+		c.notify(fmt.Sprintf("Rejected key rotation from %s: bad identity signature", session.Username))
+		return
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(frame.Key)
+	if err != nil {
+		log.Printf("Failed to parse rekey key: %v", err)
+		return
+	}
+
+	if frame.Epoch != session.Epoch+1 {
+		log.Printf("Ignoring rekey from %s for epoch %d, at epoch %d", session.Username, frame.Epoch, session.Epoch)
+		return
+	}
+
+	if frame.Reply {
+		if session.rekeyKey == nil {
+			return
+		}
+		ours := session.rekeyKey
+		session.rekeyKey = nil
+		c.installEpoch(session, frame.Epoch, ours, peerKey)
+		return
+	}
+
+	// Both sides started a rekey at once, the lower member ID's proposal wins
+	if session.rekeyKey != nil {
+		if c.MemberID < frame.Member {
+			return
+		}
+		session.rekeyKey = nil
+	}
+
+	ours, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Printf("Failed to generate rekey key: %v", err)
+		return
+	}
+	if err := c.sendRekey(session, frame.Epoch, ours, true); err != nil {
+		log.Printf("Failed to answer rekey: %v", err)
+		return
+	}
+	c.installEpoch(session, frame.Epoch, ours, peerKey)
+}
+
+// Switches the session to the next epoch's ratchet, c.mu must be held
+func (c *User) installEpoch(session *peerSession, epoch uint32, ours *ecdh.PrivateKey, peer *ecdh.PublicKey) {
+	rootKey, err := rekeyRootKey(session.rekeySecret, epoch, ours, peer)
+	if err != nil {
+		log.Printf("Rekey with %s failed: %v", session.Username, err)
+		return
+	}
+
+	suite, err := common.LookupCipherSuite(session.Suite)
+	if err != nil {
+		log.Printf("Rekey with %s failed: %v", session.Username, err)
+		return
+	}
+
+	ratchet, err := common.NewRatchetWithSuite(suite, rootKey, ours, peer)
+	if err != nil {
+		log.Printf("Rekey with %s failed: %v", session.Username, err)
+		return
+	}
+
+	session.previous = session.ratchet
+	session.ratchet = ratchet
+	session.rekeySecret = common.DeriveKey(rootKey, nil, rekeySecretInfo, 32)
+	session.Epoch = epoch
+	session.epochStarted = time.Now()
+	session.epochMessages = 0
+
+	c.notify(fmt.Sprintf("Keys with %s rotated, now at epoch %d", session.Username, epoch))
+}
+
+// The next epoch's root key: a fresh X25519 output salted with the previous
+// epoch's secret and bound to the epoch number and both keys
+func rekeyRootKey(secret []byte, epoch uint32, ours *ecdh.PrivateKey, peer *ecdh.PublicKey) ([]byte, error) {
+	shared, err := ours.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	first, second := ours.PublicKey().Bytes(), peer.Bytes()
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+
+	info := binary.BigEndian.AppendUint32(append([]byte{}, rekeyRootInfo...), epoch)
+	info = append(append(info, first...), second...)
+	return common.DeriveKey(shared, secret, info, 32), nil
+}
@@ -0,0 +1,267 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+// createRoomTimeout bounds the whole POST /rooms request
+const createRoomTimeout = 10 * time.Second
+
+var errNotOwner = errors.New("only the room owner can do that")
+
+// roomControl asks the server to kick or ban a member, or lock the room
+type roomControl struct {
+	Type   string `json:"type"`
+	Member string `json:"member,omitempty"`
+}
+
+// SetRoomSize sets how many members a room we create may hold, 0 leaves it
+// to the server (2 unless configured otherwise)
+func (c *User) SetRoomSize(members int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roomSize = members
+}
+
+// CreateRoom asks the server for a new room and returns its code. The server
+// picks the room ID, the password part is made up here and never sent.
+// Joining the room afterwards makes us its owner.
+func (c *User) CreateRoom(serverURL string) (string, error) {
+	c.mu.Lock()
+	request := common.CreateRoomRequest{Members: c.roomSize, Channel: c.wordCodes}
+	c.mu.Unlock()
+
+	body, _ := json.Marshal(request)
+	resp, err := c.httpClient().Post(httpURL(serverURL)+"/rooms", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return "", fmt.Errorf("server refused to create a room: %s", strings.TrimSpace(string(reason)))
+	}
+
+	var created common.CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || created.Room == "" {
+		return "", errors.New("invalid room from the server")
+	}
+
+	c.mu.Lock()
+	c.ownerTokens[created.Room] = created.OwnerToken
+	c.mu.Unlock()
+	if request.Channel {
+		return GenerateWordCode(created.Room), nil
+	}
+	return GenerateRoomCode(created.Room), nil
+}
+
+// Plain HTTP requests check the server the same way the websocket dialer does
+func (c *User) httpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.dialer != nil {
+		transport.TLSClientConfig = c.dialer.TLSClientConfig
+	}
+	return &http.Client{Transport: transport, Timeout: createRoomTimeout}
+}
+
+// ws:// becomes http:// and wss:// https://
+func httpURL(serverURL string) string {
+	return "http" + strings.TrimPrefix(serverURL, "ws")
+}
+
+// SetWordCodes makes rooms we create get word codes, like
+// 7-apple-river-stone-tiger, instead of letters
+func (c *User) SetWordCodes(words bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wordCodes = words
+}
+
+// WaitForRoom waits until a session with a peer is up, or the server turns
+// us away from the room
+func (c *User) WaitForRoom() error {
+	select {
+	case <-c.KeyExchangeDone:
+		return nil
+	case reason := <-c.refusals:
+		return errors.New(reason)
+	}
+}
+
+// IsRoomOwner reports whether we own the room and may kick, ban and lock
+func (c *User) IsRoomOwner() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isRoomOwner()
+}
+
+func (c *User) isRoomOwner() bool {
+	return c.MemberID != "" && c.roomOwner == c.MemberID
+}
+
+// RoomLocked reports whether the room refuses new members
+func (c *User) RoomLocked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.roomLocked
+}
+
+// Kick removes a peer from the room, they may come back unless it is locked
+func (c *User) Kick(username string) error {
+	return c.removeMember("kick", username)
+}
+
+// Ban removes a peer from the room and keeps their address out of it
+func (c *User) Ban(username string) error {
+	return c.removeMember("ban", username)
+}
+
+func (c *User) removeMember(action, username string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.isRoomOwner() {
+		return errNotOwner
+	}
+
+	// Peers still in the handshake count too, one failing key confirmation
+	// is exactly who to kick
+	member := ""
+	for id, session := range c.sessions {
+		if session.Username == username {
+			member = id
+		}
+	}
+	for id, pending := range c.pending {
+		if member == "" && pending.peerName == username {
+			member = id
+		}
+	}
+	if member == "" {
+		return fmt.Errorf("no peer named %s", username)
+	}
+
+	return c.writeJSON(roomControl{Type: action, Member: member})
+}
+
+// LockRoom stops anyone new from joining, members who drop can still resume
+func (c *User) LockRoom() error {
+	return c.setRoomLock("lock")
+}
+
+// UnlockRoom lets new members join again
+func (c *User) UnlockRoom() error {
+	return c.setRoomLock("unlock")
+}
+
+func (c *User) setRoomLock(action string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.isRoomOwner() {
+		return errNotOwner
+	}
+	// Locking by hand counts, we won't lock again behind the owner's back
+	c.autoLocked = true
+	return c.writeJSON(roomControl{Type: action})
+}
+
+// Locks the room once the conversation has started and everyone it holds is
+// in, if we own it. A room without a limit is left open. Only once, so an
+// /unlock sticks. c.mu must be held.
+func (c *User) maybeAutoLock() {
+	if !c.isRoomOwner() || c.roomLocked || c.autoLocked {
+		return
+	}
+	if c.roomCapacity == 0 || len(c.sessions)+1 < c.roomCapacity {
+		return
+	}
+
+	c.autoLocked = true
+	if err := c.writeJSON(roomControl{Type: "lock"}); err != nil {
+		log.Printf("Failed to lock the room: %v", err)
+	}
+}
+
+// The owner left and the server handed the room to someone else
+func (c *User) handleOwner(msg []byte) {
+	var frame memberFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		log.Println("Invalid owner format")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.roomOwner = frame.Member
+	if c.isRoomOwner() {
+		c.notify("You now own the room and can /kick, /ban and /lock")
+	}
+}
+
+func (c *User) handleRoomLock(locked bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.roomLocked = locked
+	if locked {
+		c.notify("The room is locked, no one new can join")
+	} else {
+		c.notify("The room is unlocked, anyone with the code can join")
+	}
+}
+
+func (c *User) handleRoomError(msg []byte) {
+	var frame memberFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		log.Println("Invalid room error format")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notify("The server refused: " + frame.Message)
+}
+
+// Clears everything we knew about the room, c.mu must be held
+func (c *User) resetRoom() {
+	c.resumeToken = ""
+	c.MemberID = ""
+	c.sessions = make(map[string]*peerSession)
+	c.pending = make(map[string]*handshake)
+	c.outbox = nil
+	c.roomOwner = ""
+	c.roomLocked = false
+	c.roomCapacity = 0
+	c.autoLocked = false
+}
+
+// Reports whether the server closed the connection for good: the room is
+// unknown, expired, full or locked, or we were kicked or banned
+func roomRefusal(err error) (string, bool) {
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		return "", false
+	}
+
+	switch closeErr.Text {
+	case common.RoomRefusedUnknown, common.RoomRefusedExpired, common.RoomRefusedFull,
+		common.RoomRefusedLocked, common.RoomRefusedBanned, common.RoomRefusedKicked:
+		return closeErr.Text, true
+	}
+	return "", false
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+const (
+	roomPasswordLength = 6                                  // never leaves the client, feeds the PAKE
+	letterBytes        = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // No confusing chars
+	codeWords          = 3                                  // password words in a word code, before the check word
+)
+
+// GenerateRoomCode returns a code of the form ROOM-PASSWORD for a room the
+// server made. Only the room part is sent to the server; the password part
+// keys the PAKE between peers.
+func GenerateRoomCode(roomID string) string {
+	return roomID + "-" + randomCode(roomPasswordLength)
+}
+
+// GenerateWordCode returns a code that is easier to read out, like
+// 7-apple-river-stone-tiger: the room's channel number, three words for the
+// password and a check word, so a typo is caught before dialing.
+func GenerateWordCode(channel string) string {
+	words := make([]string, codeWords)
+	for i := range words {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(wordlist))))
+		words[i] = wordlist[n.Int64()]
+	}
+
+	code := channel + "-" + strings.Join(words, "-")
+	return code + "-" + checkWord(code)
+}
+
+func randomCode(length int) string {
+	b := make([]byte, length)
+	for i := range b {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(letterBytes))))
+		b[i] = letterBytes[n.Int64()]
+	}
+	return string(b)
+}
+
+// SplitRoomCode separates a room code into its routing and password parts.
+// A word code with an unknown word or the wrong check word is refused.
+func SplitRoomCode(code string) (string, string, error) {
+	roomID, password, found := strings.Cut(strings.ToUpper(strings.TrimSpace(code)), "-")
+	if !found || roomID == "" || password == "" {
+		return "", "", errors.New("invalid room code, expected ROOM-PASSWORD")
+	}
+
+	if isChannel(roomID) {
+		if err := checkWordCode(roomID, password); err != nil {
+			return "", "", err
+		}
+	}
+	return roomID, password, nil
+}
+
+// Word codes route on a channel number, the server's other room IDs always
+// have a letter in them
+func isChannel(roomID string) bool {
+	return strings.Trim(roomID, "0123456789") == ""
+}
+
+func checkWordCode(channel, password string) error {
+	words := strings.Split(strings.ToLower(password), "-")
+	if len(words) != codeWords+1 {
+		return fmt.Errorf("invalid room code, expected %d words after the channel", codeWords+1)
+	}
+
+	for _, word := range words {
+		if _, found := slices.BinarySearch(wordlist[:], word); !found {
+			return fmt.Errorf("invalid room code, %q is not a code word", word)
+		}
+	}
+	if checkWord(channel+"-"+strings.Join(words[:codeWords], "-")) != words[codeWords] {
+		return errors.New("invalid room code, check it for a typo")
+	}
+	return nil
+}
+
+// The word that ends a word code, picked by a hash of everything before it
+func checkWord(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(code)))
+	return wordlist[binary.BigEndian.Uint16(sum[:])%uint16(len(wordlist))]
+}
+
+// Completes the word being typed at the end of a word code, returning the
+// whole code for each word it could be
+func completeWordCode(code string) []string {
+	channel, _, found := strings.Cut(code, "-")
+	i := strings.LastIndex(code, "-")
+	if !found || !isChannel(channel) || i == len(code)-1 {
+		return nil
+	}
+
+	prefix := strings.ToLower(code[i+1:])
+	var codes []string
+	for _, word := range wordlist {
+		// A finished word needs no completing
+		if strings.HasPrefix(word, prefix) && word != prefix {
+			codes = append(codes, code[:i+1]+word)
+		}
+	}
+	return codes
+}
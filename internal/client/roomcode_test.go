@@ -0,0 +1,45 @@
+package client_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Theknighttron/Xtty/internal/client"
+)
+
+func TestWordCodes(t *testing.T) {
+	code := client.GenerateWordCode("7")
+	words := strings.Split(code, "-")
+	if len(words) != 5 || words[0] != "7" {
+		t.Fatalf("Expected a channel and four words, got %s", code)
+	}
+
+	roomID, password, err := client.SplitRoomCode(" " + strings.ToUpper(code) + " ")
+	if err != nil {
+		t.Fatalf("Failed to split %s: %v", code, err)
+	}
+	if roomID != "7" || !strings.EqualFold(password, strings.Join(words[1:], "-")) {
+		t.Errorf("Split %s into %s and %s", code, roomID, password)
+	}
+
+	// Every word but the right one fails the check
+	wrongCheck := "apple"
+	if words[4] == wrongCheck {
+		wrongCheck = "zebra"
+	}
+	for _, typo := range []string{
+		strings.Join(append(words[:4:4], wrongCheck), "-"),
+		strings.Join(append(words[:4:4], words[4][:len(words[4])-1]), "-"),
+		strings.Join(words[:4], "-"),
+		code + "-" + words[1],
+	} {
+		if _, _, err := client.SplitRoomCode(typo); err == nil {
+			t.Errorf("Accepted the mistyped code %s", typo)
+		}
+	}
+
+	// Letter codes don't have a check word
+	if _, _, err := client.SplitRoomCode(client.GenerateRoomCode("K7QMR2XW9D")); err != nil {
+		t.Errorf("Refused a letter code: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultServer is used when neither -server, XTTY_SERVER nor the config name one
+	DefaultServer = "localhost:8080"
+	// ServerEnv overrides the server in the config, -server overrides both
+	ServerEnv = "XTTY_SERVER"
+
+	defaultPort    = 8080
+	defaultTLSPort = 443
+)
+
+// SetServer points the config at a server address written as host,
+// host:port, or a ws://, wss://, http:// or https:// URL. A URL's scheme
+// turns TLS on or off, a plain host keeps the config's setting.
+func (c *Config) SetServer(address string) error {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return fmt.Errorf("empty server address")
+	}
+
+	useTLS := c.TLS
+	hostPort := address
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return fmt.Errorf("invalid server address %q: %v", address, err)
+		}
+		switch u.Scheme {
+		case "ws", "http":
+			useTLS = false
+		case "wss", "https":
+			useTLS = true
+		default:
+			return fmt.Errorf("invalid server address %q: unsupported scheme %s", address, u.Scheme)
+		}
+		hostPort = u.Host
+	}
+
+	port := defaultPort
+	if useTLS {
+		port = defaultTLSPort
+	}
+
+	host := hostPort
+	if h, p, err := net.SplitHostPort(hostPort); err == nil {
+		host = h
+		port, err = strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port in server address %q", address)
+		}
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		return fmt.Errorf("invalid server address %q: no host", address)
+	}
+
+	c.ServerHost = host
+	c.ServerPort = port
+	c.TLS = useTLS
+	return nil
+}
+
+// ServerOverride returns the server given by the -server flag, or by
+// XTTY_SERVER when the flag is empty, "" when neither is set
+func ServerOverride(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv(ServerEnv)
+}
+
+// ResolveServer applies ServerOverride on top of the server saved in the
+// config. The config file itself is left alone.
+func ResolveServer(config *Config, flagValue string) error {
+	address := ServerOverride(flagValue)
+	if address == "" {
+		return nil
+	}
+	return config.SetServer(address)
+}
@@ -0,0 +1,473 @@
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+// Every pair of room members runs its own handshake and Double Ratchet, and
+// chat messages are encrypted once per recipient. There is no shared group
+// key: when a member leaves, dropping their pairwise session is the rekey,
+// since nothing sent afterwards is ever encrypted to them.
+
+// PeerInfo describes a room member we have a confirmed session with
+type PeerInfo struct {
+	MemberID     string
+	Username     string
+	SafetyNumber string         // derived from both identity keys, compare out of band
+	Verified     bool           // set once the user compared the safety number
+	KeyChanged   bool           // the peer's identity key changed after the session was set up
+	Suite        common.SuiteID // cipher suite negotiated for the session
+	Epoch        uint32         // bumped by every key rotation
+}
+
+type peerSession struct {
+	PeerInfo
+	handshakeKey   *ecdh.PublicKey
+	identity       []byte // DER encoded identity key
+	identityKey    crypto.PublicKey
+	signatureSuite common.SuiteID
+	ratchet        *common.Ratchet
+	previous       *common.Ratchet // previous epoch, for messages sent before the peer switched
+	sendCounter    uint64          // last counter sent to this peer
+
+	canRekey      bool             // the peer's client understands rekey frames
+	canPad        bool             // the peer's client strips padded payloads
+	rekeySecret   []byte           // carried into the next epoch's root key
+	rekeyKey      *ecdh.PrivateKey // our key for a rekey we started and the peer hasn't answered
+	rekeyStarted  time.Time
+	epochStarted  time.Time
+	epochMessages int
+}
+
+// handshake is a key exchange waiting for the peer's key confirmation
+type handshake struct {
+	peerName     string
+	peerKey      *ecdh.PublicKey
+	peerIdentity []byte
+	verified     bool
+	suite        common.SuiteID
+	canRekey     bool
+	canPad       bool
+	rekeySecret  []byte
+	ratchet      *common.Ratchet
+	peerConfirm  []byte
+}
+
+// keyExchangeFrame announces our ephemeral X25519 key and PAKE element to the
+// room, signed with our long-term identity key. Clients from before suite
+// negotiation send neither Suites nor SigSuite and get the legacy suites.
+type keyExchangeFrame struct {
+	Type      string           `json:"type"`
+	From      string           `json:"from"`
+	Member    string           `json:"member"`
+	To        string           `json:"to,omitempty"`
+	Key       []byte           `json:"key"`
+	PAKE      []byte           `json:"pake"`
+	Identity  []byte           `json:"identity"`
+	Suites    []common.SuiteID `json:"suites,omitempty"`    // cipher suites we accept, most preferred first
+	SigSuite  common.SuiteID   `json:"sig_suite,omitempty"` // how Signature was made
+	Signature []byte           `json:"signature"`
+	Reply     bool             `json:"reply,omitempty"`
+}
+
+// The bytes covered by a key exchange signature. The suites are signed too,
+// so they can't be stripped to force a downgrade.
+func (f keyExchangeFrame) signedPayload() []byte {
+	fields := []interface{}{"xtty key exchange", f.From, f.Member, f.Key, f.PAKE}
+	if len(f.Suites) > 0 || f.SigSuite != "" {
+		fields = append(fields, f.Suites, f.SigSuite)
+	}
+
+	payload, _ := json.Marshal(fields)
+	return payload
+}
+
+// keyConfirmFrame proves the sender derived the same session key
+type keyConfirmFrame struct {
+	Type   string `json:"type"`
+	From   string `json:"from"`
+	Member string `json:"member"`
+	To     string `json:"to"`
+	MAC    []byte `json:"mac"`
+}
+
+// SendKeyExchange publishes our handshake key, to the whole room when to is
+// empty. Reply marks an answer to a peer's key so the peer doesn't answer
+// again. c.mu must be held, a room switch replaces the keys.
+func (c *User) SendKeyExchange(to string, reply bool) error {
+	if c.KeyPair == nil {
+		return fmt.Errorf("no key pair generated")
+	}
+	if c.identity == nil {
+		return fmt.Errorf("no identity key loaded")
+	}
+
+	frame := keyExchangeFrame{
+		Type:     "key_exchange",
+		From:     c.Username,
+		Member:   c.MemberID,
+		To:       to,
+		Key:      c.KeyPair.PublicKey().Bytes(),
+		PAKE:     c.pake.Message(),
+		Identity: c.identityPEM,
+		Suites:   common.SupportedCipherSuites(),
+		SigSuite: c.signatureSuite,
+		Reply:    reply,
+	}
+
+	signer, err := common.LookupSignatureSuite(c.signatureSuite)
+	if err != nil {
+		return err
+	}
+
+	frame.Signature, err = signer.Sign(c.identity, frame.signedPayload())
+	if err != nil {
+		return err
+	}
+
+	return c.writeJSON(frame)
+}
+
+func (c *User) handleKeyExchange(msg []byte) {
+	var frame keyExchangeFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		log.Println("Invalid key format")
+		return
+	}
+
+	pubKey, err := ecdh.X25519().NewPublicKey(frame.Key)
+	if err != nil {
+		log.Printf("Failed to parse public key: %v", err)
+		return
+	}
+
+	if frame.From == "" || strings.ContainsAny(frame.From, " \t\r\n") {
+		log.Printf("Invalid peer username %q", frame.From)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if frame.Member == "" || frame.Member == c.MemberID {
+		log.Printf("Invalid member ID %q", frame.Member)
+		return
+	}
+
+	// Duplicate announcement of a key we already have a session with
+	if session, ok := c.sessions[frame.Member]; ok && session.handshakeKey.Equal(pubKey) {
+		return
+	}
+	if pending, ok := c.pending[frame.Member]; ok && pending.peerKey.Equal(pubKey) {
+		return
+	}
+
+	peerIdentity, verified, ok := c.checkIdentity(frame)
+	if !ok {
+		return
+	}
+
+	rootKey, err := c.deriveRootKey(pubKey, frame.PAKE)
+	if err != nil {
+		log.Printf("Key agreement failed: %v", err)
+		return
+	}
+
+	suite, err := common.NegotiateCipherSuite(frame.Suites)
+	if err != nil {
+		c.notify(fmt.Sprintf("Can't talk to %s: %v", frame.From, err))
+		return
+	}
+
+	ratchet, err := common.NewRatchetWithSuite(suite, rootKey, c.KeyPair, pubKey)
+	if err != nil {
+		log.Printf("Failed to start session: %v", err)
+		return
+	}
+
+	// The session only becomes usable once the peer proves it holds the same key
+	confirmKey := common.DeriveKey(rootKey, nil, []byte("xtty key confirm"), 32)
+	c.pending[frame.Member] = &handshake{
+		peerName:     frame.From,
+		peerKey:      pubKey,
+		peerIdentity: peerIdentity,
+		verified:     verified,
+		suite:        suite.ID(),
+		canRekey:     len(frame.Suites) > 0, // only clients that negotiate suites know about rekeying
+		canPad:       len(frame.Suites) > 0, // and padded payloads
+		rekeySecret:  common.DeriveKey(rootKey, nil, rekeySecretInfo, 32),
+		ratchet:      ratchet,
+		peerConfirm:  confirmationMAC(confirmKey, frame.Key, frame.PAKE),
+	}
+
+	// The peer joined after our first announcement, answer with ours
+	if !frame.Reply {
+		if err := c.SendKeyExchange(frame.Member, true); err != nil {
+			log.Printf("Failed to send key exchange: %v", err)
+		}
+	}
+
+	// Send confirmation message
+	confirmation := keyConfirmFrame{
+		Type:   "key_confirm",
+		From:   c.Username,
+		Member: c.MemberID,
+		To:     frame.Member,
+		MAC:    confirmationMAC(confirmKey, c.KeyPair.PublicKey().Bytes(), c.pake.Message()),
+	}
+	if err := c.writeJSON(confirmation); err != nil {
+		log.Printf("Failed to send key confirmation: %v", err)
+	}
+}
+
+func (c *User) handleKeyConfirm(msg []byte) {
+	var frame keyConfirmFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		log.Println("Invalid key confirmation format")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending, ok := c.pending[frame.Member]
+	if !ok {
+		return
+	}
+	delete(c.pending, frame.Member)
+
+	if !hmac.Equal(frame.MAC, pending.peerConfirm) {
+		c.notify(fmt.Sprintf("Key confirmation with %s failed: they do not know this room's password. "+
+			"Someone may be intercepting the connection.", pending.peerName))
+		return
+	}
+
+	ourIdentity, err := x509.MarshalPKIXPublicKey(c.identity.Public())
+	if err != nil {
+		log.Printf("Failed to encode identity key: %v", err)
+		return
+	}
+
+	identityKey, err := x509.ParsePKIXPublicKey(pending.peerIdentity)
+	if err != nil {
+		log.Printf("Failed to decode identity key: %v", err)
+		return
+	}
+	signatureSuite, err := common.SignatureSuiteForKey(identityKey)
+	if err != nil {
+		log.Printf("Unusable identity key: %v", err)
+		return
+	}
+
+	session := &peerSession{
+		PeerInfo: PeerInfo{
+			MemberID:     frame.Member,
+			Username:     pending.peerName,
+			SafetyNumber: common.SafetyNumber(ourIdentity, pending.peerIdentity),
+			Verified:     pending.verified,
+			Suite:        pending.suite,
+		},
+		handshakeKey:   pending.peerKey,
+		identity:       pending.peerIdentity,
+		identityKey:    identityKey,
+		signatureSuite: signatureSuite,
+		ratchet:        pending.ratchet,
+		canRekey:       pending.canRekey,
+		canPad:         pending.canPad,
+		rekeySecret:    pending.rekeySecret,
+		epochStarted:   time.Now(),
+	}
+
+	// A confirmed session already existed, so the member now holds a different identity
+	if previous, ok := c.sessions[frame.Member]; ok && !bytes.Equal(previous.identity, session.identity) {
+		session.KeyChanged = true
+		session.Verified = false
+		c.notify(fmt.Sprintf("WARNING: %s's identity key has changed! Compare the new safety number "+
+			"with /verify before trusting this conversation.", session.Username))
+	}
+
+	// The new session counts messages from the start again
+	c.replayGuard.Reset(c.roomID(), frame.Member, c.MemberID)
+
+	c.sessions[frame.Member] = session
+	if len(c.sessions) > 1 {
+		c.notify(fmt.Sprintf("Secure session with %s established", session.Username))
+	}
+	log.Printf("Key for %s confirmed, session established", session.Username)
+
+	c.keyExchangeOnce.Do(func() { close(c.KeyExchangeDone) })
+	c.flushOutbox()
+}
+
+// A member left the room, so nothing is encrypted to them from now on
+func (c *User) handleMemberLeft(msg []byte) {
+	var frame memberFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		log.Println("Invalid member event format")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, frame.Member)
+	c.replayGuard.Reset(c.roomID(), frame.Member, c.MemberID)
+	if session, ok := c.sessions[frame.Member]; ok {
+		delete(c.sessions, frame.Member)
+		c.notify(fmt.Sprintf("%s left the room, their session keys were discarded", session.Username))
+	}
+}
+
+// Verifies the key exchange signature and looks the identity key up in the
+// contact store. Returns the DER encoded identity key, whether the user
+// verified it before, and false if the exchange must be refused.
+func (c *User) checkIdentity(frame keyExchangeFrame) ([]byte, bool, bool) {
+	identity, err := common.ParseVerifyingKeyFromPEM(frame.Identity)
+	if err != nil {
+		log.Printf("Invalid identity key from %s: %v", frame.From, err)
+		return nil, false, false
+	}
+
+	verifier, err := common.LookupSignatureSuite(frame.SigSuite)
+	if err != nil {
+		c.notify(fmt.Sprintf("Rejected key exchange from %s: %v", frame.From, err))
+		return nil, false, false
+	}
+
+	if err := verifier.Verify(identity, frame.signedPayload(), frame.Signature); err != nil {
+		c.notify(fmt.Sprintf("Rejected key exchange from %s: bad identity signature", frame.From))
+		return nil, false, false
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(identity)
+	if err != nil {
+		return nil, false, false
+	}
+	fingerprint := common.Fingerprint(der)
+
+	if c.knownPeers == nil {
+		return der, false, true
+	}
+
+	status, verified := c.knownPeers.Check(frame.From, fingerprint)
+	switch status {
+	case TrustMismatch:
+		c.keyAlert = true
+		c.notify(fmt.Sprintf("WARNING: %s presented a different identity key (%s) than the one on record. "+
+			"Refusing the session. If they really changed keys, remove their line from %s.",
+			frame.From, fingerprint, c.knownPeers.path))
+		return nil, false, false
+	case TrustNew:
+		if err := c.knownPeers.Remember(frame.From, fingerprint, false); err != nil {
+			log.Printf("Failed to record %s in known peers: %v", frame.From, err)
+		}
+		c.notify(fmt.Sprintf("First contact with %s, identity %s. Check it with /verify.", frame.From, fingerprint))
+	}
+
+	return der, verified, true
+}
+
+// Combines X25519 with the PAKE key, so the session is bound to the room
+// password the server never sees, and to both sides' handshake messages
+func (c *User) deriveRootKey(peer *ecdh.PublicKey, peerPAKE []byte) ([]byte, error) {
+	shared, err := c.KeyPair.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	pakeKey, err := c.pake.Finish(peerPAKE)
+	if err != nil {
+		return nil, err
+	}
+
+	// Order the handshake messages so both sides build the same transcript
+	ours := append(c.KeyPair.PublicKey().Bytes(), c.pake.Message()...)
+	theirs := append(peer.Bytes(), peerPAKE...)
+	if bytes.Compare(ours, theirs) > 0 {
+		ours, theirs = theirs, ours
+	}
+	transcript := append(append([]byte("xtty session"), ours...), theirs...)
+
+	return common.DeriveKey(append(shared, pakeKey...), nil, transcript, 32), nil
+}
+
+func confirmationMAC(confirmKey, key, pake []byte) []byte {
+	mac := hmac.New(sha256.New, confirmKey)
+	mac.Write(key)
+	mac.Write(pake)
+	return mac.Sum(nil)
+}
+
+// Peers lists the members we have confirmed sessions with, sorted by username
+func (c *User) Peers() []PeerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	peers := make([]PeerInfo, 0, len(c.sessions))
+	for _, session := range c.sessions {
+		peers = append(peers, session.PeerInfo)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Username < peers[j].Username })
+
+	return peers
+}
+
+// KeyAlert reports whether any peer showed up with an unexpected identity key
+func (c *User) KeyAlert() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keyAlert {
+		return true
+	}
+	for _, session := range c.sessions {
+		if session.KeyChanged {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkPeerVerified records that a peer's safety number was compared out of
+// band. The username may be left empty when there is only one peer.
+func (c *User) MarkPeerVerified(username string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if username == "" && len(c.sessions) > 1 {
+		return errors.New("more than one peer, name the one to verify")
+	}
+
+	var session *peerSession
+	for _, s := range c.sessions {
+		if username == "" || s.Username == username {
+			session = s
+			break
+		}
+	}
+	if session == nil {
+		return errors.New("no such peer")
+	}
+
+	session.Verified = true
+	session.KeyChanged = false
+	c.keyAlert = false
+
+	if c.knownPeers != nil {
+		return c.knownPeers.Remember(session.Username, common.Fingerprint(session.identity), true)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+// ErrFingerprintMismatch is returned when the server's certificate isn't the pinned one
+var ErrFingerprintMismatch = errors.New("server certificate doesn't match the pinned fingerprint")
+
+// ServerURL is the base URL of the configured server, ws:// or wss://
+func (c *Config) ServerURL() string {
+	scheme := "ws"
+	if c.TLS {
+		scheme = "wss"
+	}
+	return scheme + "://" + net.JoinHostPort(c.ServerHost, strconv.Itoa(c.ServerPort))
+}
+
+// Dialer returns a websocket dialer that checks the server the way the
+// config asks
+func (c *Config) Dialer() (*websocket.Dialer, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{common.Subprotocol}
+	if !c.TLS {
+		return &dialer, nil
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer.TLSClientConfig = tlsConfig
+	return &dialer, nil
+}
+
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.TLSCAFile != "" {
+		data, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", c.TLSCAFile)
+		}
+	}
+
+	if c.TLSFingerprint != "" {
+		pinned, err := common.ParseFingerprint(c.TLSFingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		// Without a CA the pin is the only check, the chain can't be verified
+		config.InsecureSkipVerify = c.TLSCAFile == ""
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return ErrFingerprintMismatch
+			}
+			got := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if !bytes.Equal(got[:], pinned) {
+				return ErrFingerprintMismatch
+			}
+			return nil
+		}
+	}
+
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
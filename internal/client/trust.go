@@ -0,0 +1,127 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TrustStatus is the result of checking a peer's identity key against the contact store
+type TrustStatus int
+
+const (
+	TrustNew      TrustStatus = iota // never seen this username before
+	TrustKnown                       // key matches the one recorded on first use
+	TrustMismatch                    // username is known with a different key
+)
+
+type knownPeer struct {
+	fingerprint string
+	verified    bool
+}
+
+// KnownPeers is a trust-on-first-use store of username -> identity key
+// fingerprint, kept in the style of ssh's known_hosts:
+//
+//	alice SHA256:3q2+7w... verified
+type KnownPeers struct {
+	path  string
+	peers map[string]knownPeer
+	mu    sync.Mutex
+}
+
+// LoadKnownPeers reads the contact store, an absent file is an empty store
+func LoadKnownPeers(path string) (*KnownPeers, error) {
+	k := &KnownPeers{
+		path:  path,
+		peers: make(map[string]knownPeer),
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: malformed entry", path, line)
+		}
+
+		k.peers[fields[0]] = knownPeer{
+			fingerprint: fields[1],
+			verified:    len(fields) > 2 && fields[2] == "verified",
+		}
+	}
+
+	return k, scanner.Err()
+}
+
+// Check compares a peer's fingerprint with the one recorded for its username
+func (k *KnownPeers) Check(username, fingerprint string) (TrustStatus, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	peer, ok := k.peers[username]
+	switch {
+	case !ok:
+		return TrustNew, false
+	case peer.fingerprint != fingerprint:
+		return TrustMismatch, false
+	default:
+		return TrustKnown, peer.verified
+	}
+}
+
+// Remember records a peer's fingerprint, replacing any previous entry
+func (k *KnownPeers) Remember(username, fingerprint string, verified bool) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.peers[username] = knownPeer{fingerprint: fingerprint, verified: verified}
+	return k.save()
+}
+
+// Rewrites the whole file so entries stay sorted and unique
+func (k *KnownPeers) save() error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+
+	usernames := make([]string, 0, len(k.peers))
+	for username := range k.peers {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var b strings.Builder
+	for _, username := range usernames {
+		peer := k.peers[username]
+		fmt.Fprintf(&b, "%s %s", username, peer.fingerprint)
+		if peer.verified {
+			b.WriteString(" verified")
+		}
+		b.WriteString("\n")
+	}
+
+	return os.WriteFile(k.path, []byte(b.String()), 0600)
+}
+
+// Return the default path for the contact store
+func GetDefaultKnownPeersPath() string {
+	return filepath.Join(filepath.Dir(GetDefaultConfigPath()), "known_peers")
+}
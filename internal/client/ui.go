@@ -31,6 +31,19 @@ func NewUI(user *User) *UI {
 		SetLabel("> ").
 		SetFieldWidth(0)
 
+	// Tab completes the words of a word code after /join
+	ui.inputField.SetAutocompleteFunc(func(text string) []string {
+		code, found := strings.CutPrefix(text, "/join ")
+		if !found {
+			return nil
+		}
+		var entries []string
+		for _, completed := range completeWordCode(code) {
+			entries = append(entries, "/join "+completed)
+		}
+		return entries
+	})
+
 	ui.statusView = tview.NewTextView().
 		SetDynamicColors(true)
 
@@ -41,7 +54,7 @@ func (ui *UI) Run() error {
 	ui.updateStatus()
 
 	// Wait for initial connection
-	if ui.user.PeerPubKey == nil && ui.user.RoomCode != "" {
+	if len(ui.user.Peers()) == 0 && ui.user.RoomCode != "" {
 		ui.displaySystemMessage("Establishing secure connection...")
 		select {
 		case <-ui.user.KeyExchangeDone:
@@ -86,11 +99,11 @@ func (ui *UI) handleCommand(cmd string) {
 	switch parts[0] {
 	case "/join":
 		if len(parts) < 2 {
-			ui.displaySystemMessage("Usage: /join ROOM_CODE")
+			ui.displaySystemMessage("Usage: /join ROOM-PASSWORD or /join CHANNEL-WORDS")
 			return
 		}
 		ui.displaySystemMessage(fmt.Sprintf("Joining room: %s", parts[1]))
-		if err := ui.user.JoinRoom("ws://localhost:8080", parts[1]); err != nil {
+		if err := ui.user.JoinRoom(ui.user.serverURL, parts[1]); err != nil {
 			ui.displaySystemMessage(fmt.Sprintf("Join failed: %v", err))
 		} else {
 			// Wait for key exchange after joining
@@ -108,13 +121,92 @@ func (ui *UI) handleCommand(cmd string) {
 				}
 			}()
 		}
+	case "/new":
+		code, err := ui.user.CreateRoom(ui.user.serverURL)
+		if err != nil {
+			ui.displaySystemMessage(fmt.Sprintf("Creating a room failed: %v", err))
+			return
+		}
+		if err := ui.user.JoinRoom(ui.user.serverURL, code); err != nil {
+			ui.displaySystemMessage(fmt.Sprintf("Join failed: %v", err))
+			return
+		}
+		ui.displaySystemMessage(fmt.Sprintf("Your room code: %s\nShare this with your peer to connect", code))
+		ui.updateStatus()
+	case "/kick", "/ban":
+		if len(parts) < 2 {
+			ui.displaySystemMessage(fmt.Sprintf("Usage: %s NAME", parts[0]))
+			return
+		}
+		remove := ui.user.Kick
+		if parts[0] == "/ban" {
+			remove = ui.user.Ban
+		}
+		if err := remove(parts[1]); err != nil {
+			ui.displaySystemMessage(fmt.Sprintf("%s failed: %v", strings.TrimPrefix(parts[0], "/"), err))
+		}
+	case "/lock":
+		if err := ui.user.LockRoom(); err != nil {
+			ui.displaySystemMessage(fmt.Sprintf("Lock failed: %v", err))
+		}
+	case "/unlock":
+		if err := ui.user.UnlockRoom(); err != nil {
+			ui.displaySystemMessage(fmt.Sprintf("Unlock failed: %v", err))
+		}
+	case "/verify":
+		ui.handleVerify(parts[1:])
+	case "/rekey":
+		var username string
+		if len(parts) > 1 {
+			username = parts[1]
+		}
+		if err := ui.user.Rekey(username); err != nil {
+			ui.displaySystemMessage(fmt.Sprintf("Rekey failed: %v", err))
+			return
+		}
+		ui.displaySystemMessage("Key rotation started")
 	case "/help":
-		ui.displaySystemMessage("Commands:\n/join ROOM_CODE - Join a room\n/help - Show this help")
+		ui.displaySystemMessage("Commands:\n/join CODE - Join a room, Tab completes the words of a word code\n/new - Create a room and join it\n" +
+			"/verify [confirm [NAME]] - Show safety numbers, or mark a peer verified\n" +
+			"/rekey [NAME] - Rotate session keys now\n" +
+			"/kick NAME, /ban NAME - Remove a peer from the room, a ban keeps them out (owner only)\n" +
+			"/lock, /unlock - Stop or allow new members joining (owner only)\n/help - Show this help")
 	default:
 		ui.displaySystemMessage(fmt.Sprintf("Unknown command: %s", parts[0]))
 	}
 }
 
+func (ui *UI) handleVerify(args []string) {
+	peers := ui.user.Peers()
+	if len(peers) == 0 {
+		ui.displaySystemMessage("No peer connected yet")
+		return
+	}
+
+	if len(args) > 0 && args[0] == "confirm" {
+		var username string
+		if len(args) > 1 {
+			username = args[1]
+		}
+		if err := ui.user.MarkPeerVerified(username); err != nil {
+			ui.displaySystemMessage(fmt.Sprintf("Verify failed: %v", err))
+			return
+		}
+		ui.displaySystemMessage("Peer marked as verified")
+		ui.updateStatus()
+		return
+	}
+
+	for _, peer := range peers {
+		state := "unverified"
+		if peer.Verified {
+			state = "verified"
+		}
+		ui.displaySystemMessage(fmt.Sprintf("Safety number with %s (%s):\n%s", peer.Username, state, peer.SafetyNumber))
+	}
+	ui.displaySystemMessage("Compare it with your peer over another channel, then run /verify confirm [NAME]")
+}
+
 func (ui *UI) messagePoller() {
 	ticker := time.NewTicker(300 * time.Millisecond)
 	defer ticker.Stop()
@@ -122,13 +214,19 @@ func (ui *UI) messagePoller() {
 	for {
 		select {
 		case <-ui.user.Done:
+			// Show why the connection ended
+			ui.app.QueueUpdateDraw(func() {
+				for _, msg := range ui.user.TakeMessages() {
+					ui.displayMessage(msg)
+				}
+				ui.updateStatus()
+			})
 			return
 		case <-ticker.C:
 			ui.app.QueueUpdateDraw(func() {
-				for _, msg := range ui.user.Messages {
+				for _, msg := range ui.user.TakeMessages() {
 					ui.displayMessage(msg)
 				}
-				ui.user.Messages = nil // Clear displayed messages
 				ui.updateStatus()
 			})
 		}
@@ -136,6 +234,11 @@ func (ui *UI) messagePoller() {
 }
 
 func (ui *UI) displayMessage(msg Message) {
+	if msg.System {
+		ui.displaySystemMessage(msg.Content)
+		return
+	}
+
 	var prefix, color string
 	if msg.Sent {
 		color = "[blue]"
@@ -153,8 +256,44 @@ func (ui *UI) displaySystemMessage(text string) {
 
 func (ui *UI) updateStatus() {
 	status := fmt.Sprintf("[yellow]%s[white] | Room: %s", ui.user.Username, ui.user.RoomCode)
-	if ui.user.PeerPubKey != nil {
-		status += " | [green]Connected[white]"
+	if ui.user.IsRoomOwner() {
+		status += " (owner)"
+	}
+	if ui.user.RoomLocked() {
+		status += " | Locked"
+	}
+	if ui.user.KeyAlert() {
+		status = "[white:red] PEER KEY CHANGED - run /verify [-:-] " + status
+	}
+
+	peers := ui.user.Peers()
+	if ui.user.RoomCode != "" && !ui.user.Connected() {
+		if attempt := ui.user.ReconnectAttempt(); attempt > 0 {
+			status += fmt.Sprintf(" | [yellow]Reconnecting (attempt %d)...[white]", attempt)
+		} else {
+			status += " | [red]Disconnected[white]"
+		}
+	} else if len(peers) == 1 {
+		status += fmt.Sprintf(" | [green]Connected[white] | Epoch %d", peers[0].Epoch)
+		if peers[0].Verified {
+			status += " | [green]Verified[white]"
+		} else {
+			// First two groups are enough to spot a mismatch at a glance
+			status += fmt.Sprintf(" | Safety: %s... [yellow](unverified)[white]", peers[0].SafetyNumber[:11])
+		}
+	} else if len(peers) > 1 {
+		unverified := 0
+		oldest := peers[0].Epoch
+		for _, peer := range peers {
+			if !peer.Verified {
+				unverified++
+			}
+			oldest = min(oldest, peer.Epoch)
+		}
+		status += fmt.Sprintf(" | [green]%d peers[white] | Epoch %d", len(peers), oldest)
+		if unverified > 0 {
+			status += fmt.Sprintf(" | [yellow]%d unverified[white]", unverified)
+		}
 	} else if ui.user.RoomCode != "" {
 		status += " | [yellow]Waiting for peer...[white]"
 	} else {
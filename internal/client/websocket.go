@@ -1,29 +1,35 @@
 package client
 
 import (
+	"crypto"
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/url"
+	"sync"
 	"time"
 
 	"github.com/Theknighttron/Xtty/internal/common"
 	"github.com/gorilla/websocket"
 )
 
+// authReplyTimeout bounds each step of the login handshake
+const authReplyTimeout = 10 * time.Second
+
 // Client represents a WebSocket client
 type Client struct {
 	conn           *websocket.Conn
 	config         *Config
-	privateKey     interface{}
+	privateKey     crypto.Signer
 	messageHandler func(message *common.Message)
 	shutdownCh     chan struct{}
+	done           chan struct{} // closed when the connection drops
+	writeMu        sync.Mutex
 }
 
 // NewClient creates a new WebSocket client
 func NewClient(config *Config, messageHandler func(message *common.Message)) (*Client, error) {
 	// Parse private key
-	privateKey, err := common.ParsePrivateKeyFromPEM(config.PrivateKey)
+	privateKey, err := common.ParseSigningKeyFromPEM(config.PrivateKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse private key: %v", err)
 	}
@@ -40,41 +46,92 @@ func NewClient(config *Config, messageHandler func(message *common.Message)) (*C
 
 // connects to the WebSocket server
 func (c *Client) Connect() error {
-	// Create WebSocket URL
-	u := url.URL{
-		Scheme: "ws",
-		Host:   fmt.Sprintf("%s:%d", c.config.ServerHost, c.config.ServerPort),
-		Path:   "/ws",
+	dialer, err := c.config.Dialer()
+	if err != nil {
+		return err
 	}
 
 	// Connect to WebSocket server
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	conn, _, err := dialer.Dial(c.config.ServerURL()+"/ws", nil)
 	if err != nil {
 		return fmt.Errorf("failed to connect to WebSocket server: %v", err)
 	}
 
 	c.conn = conn
 
+	if err := c.authenticate(); err != nil {
+		conn.Close()
+		return fmt.Errorf("authentication failed: %v", err)
+	}
+
 	// Start handling messages
+	c.done = make(chan struct{})
+	keepAlive(conn, c.done)
 	go c.handleMessages()
 
-	// Send auth packet
-	authPacket := common.Packet{
-		Type:      "auth",
-		Timestamp: time.Now(),
-		Data: map[string]string{
-			"username":   c.config.Username,
-			"public_key": string(c.config.PublicKey),
-		},
+	log.Println("Connected to WebSocket server")
+
+	return nil
+}
+
+// Answers the server's challenge by signing its nonce with our private key
+func (c *Client) authenticate() error {
+	c.conn.SetReadDeadline(time.Now().Add(authReplyTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	var challenge common.ChallengePayload
+	if err := c.readPacket(common.PacketChallenge, &challenge); err != nil {
+		return err
 	}
 
+	suiteID, err := common.SignatureSuiteForKey(c.privateKey.Public())
+	if err != nil {
+		return err
+	}
+	suite, err := common.LookupSignatureSuite(suiteID)
+	if err != nil {
+		return err
+	}
+
+	signature, err := suite.Sign(c.privateKey, common.AuthChallengeMessage(c.config.Username, challenge.Nonce))
+	if err != nil {
+		return err
+	}
+
+	authPacket, err := common.NewPacket(common.PacketAuth, &common.AuthPayload{
+		Username:  c.config.Username,
+		Signature: signature,
+	})
+	if err != nil {
+		return err
+	}
 	if err := c.SendPacket(authPacket); err != nil {
 		return fmt.Errorf("failed to send auth packet: %v", err)
 	}
 
-	log.Println("Connected to WebSocket server")
+	var ok common.AuthOKPayload
+	return c.readPacket(common.PacketAuthOK, &ok)
+}
 
-	return nil
+// Reads one packet of the expected type, turning an error packet into an error
+func (c *Client) readPacket(packetType string, payload common.Payload) error {
+	var packet common.Packet
+	if err := c.conn.ReadJSON(&packet); err != nil {
+		return err
+	}
+
+	if packet.Type == common.PacketError {
+		var serverErr common.ErrorPayload
+		if err := packet.Decode(&serverErr); err != nil {
+			return err
+		}
+		return &serverErr
+	}
+	if packet.Type != packetType {
+		return fmt.Errorf("expected %s packet, got %s", packetType, packet.Type)
+	}
+
+	return packet.Decode(payload)
 }
 
 // SendPacket sends a packet to the server
@@ -84,6 +141,8 @@ func (c *Client) SendPacket(packet common.Packet) error {
 		return fmt.Errorf("failed to marshal packet: %v", err)
 	}
 
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
 		return fmt.Errorf("failed to send packet: %v", err)
 	}
@@ -110,10 +169,9 @@ func (c *Client) SendMessage(recipientID string, messageType common.MessageType,
 		Content:     content,
 	}
 
-	packet := common.Packet{
-		Type:      "message",
-		Timestamp: time.Now(),
-		Data:      message,
+	packet, err := common.NewPacket(common.PacketMessage, &message)
+	if err != nil {
+		return err
 	}
 
 	return c.SendPacket(packet)
@@ -121,6 +179,7 @@ func (c *Client) SendMessage(recipientID string, messageType common.MessageType,
 
 // handleMessages handles incoming WebSocket messages
 func (c *Client) handleMessages() {
+	defer close(c.done)
 	defer c.conn.Close()
 
 	for {
@@ -141,24 +200,24 @@ func (c *Client) handleMessages() {
 			}
 
 			switch packet.Type {
-			case "message":
+			case common.PacketMessage:
 				var message common.Message
-				messageData, err := json.Marshal(packet.Data)
-				if err != nil {
-					log.Printf("Error marshaling message data: %v", err)
-					continue
-				}
-
-				if err := json.Unmarshal(messageData, &message); err != nil {
-					log.Printf("Error unmarshaling message: %v", err)
+				if err := packet.Decode(&message); err != nil {
+					log.Printf("Invalid message: %v", err)
 					continue
 				}
 
 				if c.messageHandler != nil {
 					c.messageHandler(&message)
 				}
-			case "error":
-				log.Printf("Error from server: %v", packet.Data)
+				c.ack(&message)
+			case common.PacketError:
+				var serverErr common.ErrorPayload
+				if err := packet.Decode(&serverErr); err != nil {
+					log.Printf("Invalid error packet: %v", err)
+					continue
+				}
+				log.Printf("Error from server: %v", &serverErr)
 			default:
 				log.Printf("Received packet of type %s", packet.Type)
 			}
@@ -166,6 +225,27 @@ func (c *Client) handleMessages() {
 	}
 }
 
+// Tells the server we have a message, so it stops holding it for us
+func (c *Client) ack(message *common.Message) {
+	packet, err := common.NewPacket(common.PacketAck, &common.AckPayload{
+		MessageID: message.ID,
+		From:      message.SenderID,
+	})
+	if err != nil {
+		log.Printf("Failed to build ack: %v", err)
+		return
+	}
+	if err := c.SendPacket(packet); err != nil {
+		log.Printf("Failed to ack message: %v", err)
+	}
+}
+
+// Done is closed when the connection to the server drops, including when
+// the server stops answering keepalive pings
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
 // Disconnect disconnects from the WebSocket server
 func (c *Client) Disconnect() {
 	close(c.shutdownCh)
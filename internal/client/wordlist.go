@@ -0,0 +1,76 @@
+package client
+
+// wordlist is where word room codes come from: 512 words, 9 bits each, no two
+// starting with the same three letters, so any three letters complete a word
+// and a typo rarely lands on another one
+var wordlist = [512]string{
+	"able", "acid", "acorn", "actor", "adult", "agent", "aisle", "album", "alert",
+	"alpha", "amber", "anchor", "angle", "ankle", "apple", "april", "arch", "arena",
+	"argue", "armor", "arrow", "artist", "aspen", "atlas", "attic", "audio", "august",
+	"autumn", "awake", "axis",
+	"bacon", "badge", "bagel", "baker", "bamboo", "banana", "barrel", "basket",
+	"beach", "bench", "berry", "bingo", "birch", "blue", "boat", "body", "bonus",
+	"book", "border", "bottle", "boxer", "bread", "brick", "broom", "brush", "bucket",
+	"bugle", "bulb", "bundle", "burger", "butter",
+	"cabin", "cactus", "cafe", "camel", "candle", "carbon", "castle", "cave", "cedar",
+	"celery", "cement", "chair", "cheese", "cider", "cinema", "circle", "citrus",
+	"civic", "clam", "clever", "cliff", "clock", "coach", "cobalt", "coffee", "comet",
+	"copper", "coral", "cotton", "couch", "crab", "crown", "cube", "cuckoo",
+	"daisy", "dance", "dart", "dawn", "debate", "deer", "delta", "denim", "desert",
+	"detail", "dial", "diesel", "dinner", "dip", "dish", "divide", "doctor", "domino",
+	"donkey", "door", "double", "dove", "dragon", "dream", "drift", "drum", "duck",
+	"dune", "dust",
+	"eagle", "earth", "easel", "echo", "edge", "effort", "eight", "elbow", "elder",
+	"elk", "elm", "ember", "empire", "energy", "engine", "enjoy", "equal", "errand",
+	"escape", "essay", "exact", "exit", "expert", "extra",
+	"fabric", "face", "falcon", "family", "fancy", "farmer", "father", "fence",
+	"ferry", "fiber", "fiddle", "field", "figure", "film", "finger", "fire", "fish",
+	"flag", "flute", "fog", "folder", "food", "forest", "fossil", "fox", "frog",
+	"fruit", "fuel", "funny", "future",
+	"galaxy", "garden", "gecko", "gentle", "giant", "ginger", "globe", "goat",
+	"golden", "grape", "green", "guitar", "gulf", "gypsum",
+	"habit", "hammer", "harbor", "hazel", "heart", "hedge", "helmet", "hero", "hidden",
+	"hippo", "hobby", "hockey", "honey", "hood", "hotel", "hover", "hubcap", "human",
+	"hurdle", "husky", "hybrid",
+	"icon", "idea", "igloo", "image", "impact", "index", "infant", "ink", "inland",
+	"insect", "island", "item", "ivory",
+	"jacket", "jaguar", "jam", "jar", "jazz", "jeans", "jelly", "jersey", "jewel",
+	"jigsaw", "jockey", "jogger", "judge", "juice", "jumbo", "jungle", "jury",
+	"kayak", "kernel", "kettle", "kind", "kiwi", "knee", "knife", "koala",
+	"label", "ladder", "lagoon", "lamp", "laptop", "lark", "laser", "lava", "lawn",
+	"layer", "leader", "lemon", "lentil", "letter", "level", "lilac", "limit", "linen",
+	"lion", "liquid", "list", "little", "lizard", "locket", "lodge", "logic", "lotus",
+	"lucky", "lumber", "lunar",
+	"magnet", "maple", "marble", "mask", "meadow", "medal", "melon", "memory", "metal",
+	"middle", "mild", "mirror", "mitten", "model", "molar", "monkey", "moon", "mosaic",
+	"motor", "muffin", "museum", "mutual",
+	"napkin", "narrow", "nation", "navy", "nearby", "nectar", "needle", "neon",
+	"nephew", "nerve", "nest", "nickel", "night", "ninja", "noble", "noodle", "normal",
+	"novel", "number", "nurse", "nutmeg", "nylon",
+	"oasis", "object", "ocean", "office", "often", "olive", "omega", "onion", "opera",
+	"option", "orange", "orbit", "orchid", "organ", "origin", "otter", "ounce", "oval",
+	"oven", "owl", "oxygen", "oyster", "ozone",
+	"paddle", "palace", "panda", "paper", "parrot", "pasta", "patrol", "peach",
+	"pebble", "pencil", "pepper", "pet", "phone", "piano", "picnic", "pigeon",
+	"pillow", "pine", "pirate", "pizza", "planet", "plum", "pocket", "poem", "polar",
+	"pony", "potato", "powder", "prism", "puddle", "puppet", "purple", "puzzle",
+	"quail", "queen", "quick", "quota",
+	"rabbit", "radar", "raft", "rake", "ranch", "rapid", "raven", "razor", "ready",
+	"rebel", "record", "reef", "rescue", "rhythm", "ribbon", "rice", "riddle", "ring",
+	"ripple", "river", "road", "robot", "rocket", "rodeo", "roof", "rope", "rose",
+	"rotate", "royal", "rubber", "rudder", "rugby", "ruler", "rumble", "runway",
+	"rustic",
+	"saddle", "safari", "salad", "sand", "satin", "sauce", "scarf", "school", "scout",
+	"seal", "seed", "seven", "shelf", "ship", "shoe", "siren", "six", "skate", "skill",
+	"slate", "sled", "smile", "snail", "soap", "sofa", "south", "spoon", "squid",
+	"stone", "sugar", "surf", "swan", "syrup",
+	"table", "tango", "taxi", "tiger", "tiny", "toast", "today", "tonic", "topaz",
+	"torch", "total", "towel", "tuba", "tulip", "twin", "type",
+	"uncle", "under", "upper", "urban", "usual",
+	"vapor", "vase", "verb", "video", "view", "vine", "visit", "vital", "vivid",
+	"vocal", "vote",
+	"wagon", "warm", "wasp", "water", "wave", "west", "whale", "wheat", "wild", "wise",
+	"wolf", "wood", "woven", "wrist",
+	"yacht", "yard", "year", "yield", "yoga", "young", "yummy",
+	"zebra", "zero", "zinc", "zone", "zoom",
+}
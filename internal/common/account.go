@@ -0,0 +1,59 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// KeyRotationRequest replaces a user's registered key. It is signed with the
+// key being replaced, so only its holder can hand the account to a new one.
+type KeyRotationRequest struct {
+	Username  string    `json:"username"`
+	PublicKey []byte    `json:"public_key"` // the new key, PEM encoded
+	Timestamp time.Time `json:"timestamp"`
+	Signature []byte    `json:"signature"` // over KeyRotationMessage
+}
+
+func (k *KeyRotationRequest) Validate() error {
+	if err := ValidateUsername(k.Username); err != nil {
+		return err
+	}
+	if len(k.PublicKey) == 0 {
+		return errors.New("new public key is required")
+	}
+	if len(k.Signature) == 0 {
+		return errors.New("signature is required")
+	}
+	return nil
+}
+
+// KeyRotationMessage is what the old key signs to rotate to publicKey
+func KeyRotationMessage(username string, publicKey []byte, timestamp time.Time) []byte {
+	message, _ := json.Marshal([]interface{}{"xtty rotate key", username, publicKey, timestamp.UnixNano()})
+	return message
+}
+
+// AccountDeletionRequest removes a user and frees the username. It is signed
+// with the user's current key.
+type AccountDeletionRequest struct {
+	Username  string    `json:"username"`
+	Timestamp time.Time `json:"timestamp"`
+	Signature []byte    `json:"signature"` // over AccountDeletionMessage
+}
+
+func (a *AccountDeletionRequest) Validate() error {
+	if err := ValidateUsername(a.Username); err != nil {
+		return err
+	}
+	if len(a.Signature) == 0 {
+		return errors.New("signature is required")
+	}
+	return nil
+}
+
+// AccountDeletionMessage is what the user's key signs to delete the account
+func AccountDeletionMessage(username string, timestamp time.Time) []byte {
+	message, _ := json.Marshal([]interface{}{"xtty delete account", username, timestamp.UnixNano()})
+	return message
+}
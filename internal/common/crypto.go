@@ -4,13 +4,18 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 )
 
 // Create a new RSA key pair
@@ -37,8 +42,54 @@ func EncodePrivateKeyToPEM(privateKey *rsa.PrivateKey) []byte {
 	return privateKeyPEM
 }
 
-// Encodes the private key to PEM(Private Enhance Mail) format
-func EncodePublicKeyToPEM(publicKey *rsa.PublicKey) ([]byte, error) {
+// GenerateSigningKey creates an Ed25519 identity key
+func GenerateSigningKey() (ed25519.PrivateKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	return privateKey, err
+}
+
+// EncodeSigningKeyToPEM encodes an identity key, RSA keys in the original PKCS#1 form
+func EncodeSigningKeyToPEM(key crypto.Signer) ([]byte, error) {
+	if privateKey, ok := key.(*rsa.PrivateKey); ok {
+		return EncodePrivateKeyToPEM(privateKey), nil
+	}
+
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes}), nil
+}
+
+// ParseSigningKeyFromPEM parses an RSA or Ed25519 identity key
+func ParseSigningKeyFromPEM(privateKeyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block containing the private key")
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported identity key type %T", key)
+	}
+}
+
+// Encodes the public key to PEM(Private Enhance Mail) format
+func EncodePublicKeyToPEM(publicKey crypto.PublicKey) ([]byte, error) {
 	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
 	if err != nil {
 		return nil, err
@@ -46,7 +97,7 @@ func EncodePublicKeyToPEM(publicKey *rsa.PublicKey) ([]byte, error) {
 
 	publicKeyPEM := pem.EncodeToMemory(
 		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
+			Type:  "PUBLIC KEY",
 			Bytes: publicKeyBytes,
 		},
 	)
@@ -89,8 +140,51 @@ func ParsePublicKeyFromPEM(publicKeyPEM []byte) (*rsa.PublicKey, error) {
 	return publicKey, nil
 }
 
+// ParseVerifyingKeyFromPEM parses an RSA or Ed25519 public identity key
+func ParseVerifyingKeyFromPEM(publicKeyPEM []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block containing the public key")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return key, nil
+	case *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported identity key type %T", key)
+	}
+}
+
 // Encrypt a message using hybrid encryption
 func EncryptMessage(message []byte, publicKey *rsa.PublicKey) ([]byte, []byte, error) {
+	return encryptHybrid(message, publicKey, nil)
+}
+
+// EncryptMessageWithAD encrypts like EncryptMessage and binds the ciphertext
+// to its associated data, which the receiver must supply unchanged
+func EncryptMessageWithAD(message []byte, publicKey *rsa.PublicKey, ad AssociatedData) ([]byte, []byte, error) {
+	return encryptHybrid(message, publicKey, ad.Bytes())
+}
+
+// Decrypts a message using hybrid encryption (RSA + AES)
+func DecryptMessage(encryptedMessage, encryptedKey []byte, privateKey *rsa.PrivateKey) ([]byte, error) {
+	return decryptHybrid(encryptedMessage, encryptedKey, privateKey, nil)
+}
+
+// DecryptMessageWithAD decrypts a message from EncryptMessageWithAD, failing
+// if the associated data differs from what the sender used
+func DecryptMessageWithAD(encryptedMessage, encryptedKey []byte, privateKey *rsa.PrivateKey, ad AssociatedData) ([]byte, error) {
+	return decryptHybrid(encryptedMessage, encryptedKey, privateKey, ad.Bytes())
+}
+
+func encryptHybrid(message []byte, publicKey *rsa.PublicKey, ad []byte) ([]byte, []byte, error) {
 	// Generate a random key AES key
 	aeskey := make([]byte, 32) // 256 bits
 
@@ -98,76 +192,82 @@ func EncryptMessage(message []byte, publicKey *rsa.PublicKey) ([]byte, []byte, e
 		return nil, nil, err
 	}
 
-	// Encrypt the AES key with RSA
+	// Encrypt the AES key with RSA, the label binds it to the same associated data
 	encryptedKey, err := rsa.EncryptOAEP(
 		sha256.New(),
 		rand.Reader,
 		publicKey,
 		aeskey,
-		nil,
+		ad,
 	)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Encrypt the message with AES-GCM
-	block, err := aes.NewCipher(aeskey)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	nonce := make([]byte, 12)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, nil, err
-	}
-
-	aesgcm, err := cipher.NewGCM(block)
+	encryptedMessage, err := SealAESGCM(aeskey, message, ad)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	encryptedMessage := aesgcm.Seal(nonce, nonce, message, nil)
-
 	return encryptedMessage, encryptedKey, nil
 }
 
-// Decrypts a message using hybrid encryption (RSA + AES)
-func DecryptMessage(encryptedMessage, encryptedKey []byte, privateKey *rsa.PrivateKey) ([]byte, error) {
+func decryptHybrid(encryptedMessage, encryptedKey []byte, privateKey *rsa.PrivateKey, ad []byte) ([]byte, error) {
 	// Decrypt the AES key with RSA
 	aesKey, err := rsa.DecryptOAEP(
 		sha256.New(),
 		rand.Reader,
 		privateKey,
 		encryptedKey,
-		nil,
+		ad,
 	)
 	if err != nil {
 		return nil, err
 	}
 
 	// Decrypt the message with AES-GCM
-	block, err := aes.NewCipher(aesKey)
+	return OpenAESGCM(aesKey, encryptedMessage, ad)
+}
+
+// SealAESGCM encrypts with a 256 bit key, the random nonce is prepended to the ciphertext
+func SealAESGCM(key, plaintext, ad []byte) ([]byte, error) {
+	aesgcm, err := newAESGCM(key)
 	if err != nil {
 		return nil, err
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aesgcm.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// OpenAESGCM decrypts a ciphertext produced by SealAESGCM
+func OpenAESGCM(key, ciphertext, ad []byte) ([]byte, error) {
+	aesgcm, err := newAESGCM(key)
 	if err != nil {
 		return nil, err
 	}
 
 	nonceSize := aesgcm.NonceSize()
-	if len(encryptedMessage) < nonceSize {
+	if len(ciphertext) < nonceSize {
 		return nil, errors.New("ciphertext too short")
 	}
 
-	nonce, ciphertext := encryptedMessage[:nonceSize], encryptedMessage[nonceSize:]
-	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	return aesgcm.Open(nil, nonce, ciphertext, ad)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return plaintext, nil
+	return cipher.NewGCM(block)
 }
 
 // Signs a message with a private key
@@ -202,3 +302,50 @@ func VerifySignature(message, signature []byte, publicKey *rsa.PublicKey) error
 		signature,
 	)
 }
+
+// DeriveKey expands a shared secret into length bytes of key material (HKDF-SHA256)
+func DeriveKey(secret, salt, info []byte, length int) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+
+	// Extract
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(secret)
+	prk := extractor.Sum(nil)
+
+	// Expand
+	var okm, block []byte
+	for counter := byte(1); len(okm) < length; counter++ {
+		expander := hmac.New(sha256.New, prk)
+		expander.Write(block)
+		expander.Write(info)
+		expander.Write([]byte{counter})
+		block = expander.Sum(nil)
+		okm = append(okm, block...)
+	}
+
+	return okm[:length]
+}
+
+// CertificateFingerprint is the SHA-256 of a DER certificate as colon
+// separated hex, the form the server prints for clients to pin
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = hex.EncodeToString([]byte{b})
+	}
+	return strings.Join(parts, ":")
+}
+
+// ParseFingerprint reads a certificate fingerprint written with or without
+// colons, in either case
+func ParseFingerprint(fingerprint string) ([]byte, error) {
+	cleaned := strings.NewReplacer(":", "", " ", "").Replace(fingerprint)
+	sum, err := hex.DecodeString(cleaned)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid certificate fingerprint %q", fingerprint)
+	}
+	return sum, nil
+}
@@ -1,6 +1,7 @@
 package common_test
 
 import (
+	"errors"
 	"github.com/Theknighttron/Xtty/internal/common"
 	"testing"
 )
@@ -62,3 +63,89 @@ func TestSignatureVerification(t *testing.T) {
 		t.Errorf("Verification of tampered message should fail")
 	}
 }
+
+func TestSafetyNumber(t *testing.T) {
+	keyA := []byte("alice public key")
+	keyB := []byte("bob public key")
+
+	// Both sides must see the same number
+	number := common.SafetyNumber(keyA, keyB)
+	if number != common.SafetyNumber(keyB, keyA) {
+		t.Errorf("Safety number depends on key order")
+	}
+
+	if len(number) != 12*5+11 {
+		t.Errorf("Unexpected safety number format: %q", number)
+	}
+
+	// A different key must change the number
+	if number == common.SafetyNumber(keyA, []byte("mallory public key")) {
+		t.Errorf("Safety number didn't change with the key")
+	}
+}
+
+func TestEncryptionWithAssociatedData(t *testing.T) {
+	privateKey, publicKey, err := common.GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	ad := common.AssociatedData{Room: "K7QM", Sender: "alice", Recipient: "bob", MessageID: "1", Counter: 1}
+	encryptedMessage, encryptedKey, err := common.EncryptMessageWithAD([]byte("hello bob"), publicKey, ad)
+	if err != nil {
+		t.Fatalf("Failed to encrypt message: %v", err)
+	}
+
+	if _, err := common.DecryptMessageWithAD(encryptedMessage, encryptedKey, privateKey, ad); err != nil {
+		t.Fatalf("Failed to decrypt message: %v", err)
+	}
+
+	// Lifting the ciphertext into another room, or flipping the clear text
+	// epoch or padding flag, must fail
+	moved := ad
+	moved.Room = "ZZZZ"
+	rekeyed := ad
+	rekeyed.Epoch = 1
+	padded := ad
+	padded.Padded = true
+	for _, changed := range []common.AssociatedData{moved, rekeyed, padded} {
+		if _, err := common.DecryptMessageWithAD(encryptedMessage, encryptedKey, privateKey, changed); err == nil {
+			t.Errorf("Decryption with different associated data %+v should fail", changed)
+		}
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	guard := common.NewReplayGuard(8)
+	ad := common.AssociatedData{Room: "K7QM", Sender: "alice", Recipient: "bob"}
+
+	accept := func(counter uint64) error {
+		ad.Counter = counter
+		return guard.Accept(ad)
+	}
+
+	for _, counter := range []uint64{1, 3, 2, 10} {
+		if err := accept(counter); err != nil {
+			t.Fatalf("Counter %d rejected: %v", counter, err)
+		}
+	}
+
+	if err := accept(3); !errors.Is(err, common.ErrReplayedMessage) {
+		t.Errorf("Replayed counter returned %v, want ErrReplayedMessage", err)
+	}
+
+	// Within the window but never seen
+	if err := accept(4); err != nil {
+		t.Errorf("Reordered counter inside the window rejected: %v", err)
+	}
+
+	if err := accept(2); !errors.Is(err, common.ErrMessageTooOld) {
+		t.Errorf("Counter behind the window returned %v, want ErrMessageTooOld", err)
+	}
+
+	// Other streams are tracked separately
+	ad.Sender = "carol"
+	if err := accept(3); err != nil {
+		t.Errorf("Counter from another sender rejected: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	fingerprintIterations = 5200
+	safetyNumberGroups    = 12
+)
+
+// Fingerprint returns an OpenSSH style fingerprint of a DER encoded public key
+func Fingerprint(publicKey []byte) string {
+	digest := sha256.Sum256(publicKey)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(digest[:])
+}
+
+// SafetyNumber derives a 60 digit number from two public keys, for peers to
+// compare out of band. It is the same whichever side computes it.
+func SafetyNumber(keyA, keyB []byte) string {
+	a, b := fingerprintDigits(keyA), fingerprintDigits(keyB)
+	if a > b {
+		a, b = b, a
+	}
+	digits := a + b
+
+	groups := make([]string, 0, safetyNumberGroups)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+
+	return strings.Join(groups, " ")
+}
+
+// Turns an iterated hash of the key into 30 decimal digits
+func fingerprintDigits(key []byte) string {
+	digest := sha512.Sum512(append([]byte("xtty fingerprint"), key...))
+	for i := 1; i < fingerprintIterations; i++ {
+		digest = sha512.Sum512(append(digest[:], key...))
+	}
+
+	var digits strings.Builder
+	for i := 0; i < 30; i += 5 {
+		// 5 bytes of digest per 5 digit chunk
+		chunk := binary.BigEndian.Uint64(append([]byte{0, 0, 0}, digest[i:i+5]...))
+		fmt.Fprintf(&digits, "%05d", chunk%100000)
+	}
+
+	return digits.String()
+}
@@ -1,6 +1,12 @@
 package common
 
-import "time"
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"time"
+)
 
 // MessageType defines different types of message in the system
 type MessageType int
@@ -31,9 +37,10 @@ const (
 type User struct {
 	Username   string     `json:"username"`
 	PublicKey  []byte     `json:"public_key"`
-	Status     UserStatus `json:"status"`
-	LastSeen   time.Time  `json:"last_seen"`
+	Status     UserStatus `json:"status"`    // as registered, the server keeps live presence in memory
+	LastSeen   time.Time  `json:"last_seen"` // as registered, likewise
 	FriendList []string   `json:"friend_list,omitempty"`
+	KeyUpdated time.Time  `json:"key_updated,omitempty"` // when PublicKey was registered or last rotated
 }
 
 // Message represents a message in the system (both encrypted and system messages)
@@ -43,21 +50,82 @@ type Message struct {
 	RecipientID string      `json:"recipient_id"`
 	Type        MessageType `json:"type"`
 	Timestamp   time.Time   `json:"timestamp"`
+	Counter     uint64      `json:"counter,omitempty"` // per sender/recipient, for replay protection
 
-	// For encrypted Messages
-	EncryptedContent []byte `json:"encrypted_content,omitempty"`
-	EncryptedKey     []byte `json:"encrypted_key,omitempty"`
-	Signature        []byte `json:"signature,omitempty"`
+	// For encrypted Messages. Legacy senders fill EncryptedContent and
+	// EncryptedKey; everyone else sends an Envelope naming its suite.
+	Envelope         *Envelope `json:"envelope,omitempty"`
+	EncryptedContent []byte    `json:"encrypted_content,omitempty"`
+	EncryptedKey     []byte    `json:"encrypted_key,omitempty"`
+	Signature        []byte    `json:"signature,omitempty"`
 
 	// For system messages
 	Content string `json:"content,omitempty"`
 }
 
+// AssociatedData returns the fields an encrypted message is bound to
+func (m *Message) AssociatedData(room string) AssociatedData {
+	return AssociatedData{
+		Room:      room,
+		Sender:    m.SenderID,
+		Recipient: m.RecipientID,
+		MessageID: m.ID,
+		Counter:   m.Counter,
+	}
+}
+
+// Seal encrypts content to the recipient with the given suite. The legacy
+// suite uses the original fields so older clients can still read it; every
+// other suite pads the content first to hide its length.
+func (m *Message) Seal(suite SuiteID, recipient crypto.PublicKey, keyID string, content []byte, room string) error {
+	ad := m.AssociatedData(room)
+
+	if suite == "" || suite == LegacyCipherSuite {
+		publicKey, ok := recipient.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("legacy suite needs an RSA recipient key")
+		}
+
+		var err error
+		m.Envelope = nil
+		m.EncryptedContent, m.EncryptedKey, err = EncryptMessageWithAD(content, publicKey, ad)
+		return err
+	}
+
+	envelope, err := SealEnvelope(suite, recipient, keyID, Pad(content), ad.Bytes())
+	if err != nil {
+		return err
+	}
+
+	m.Envelope = envelope
+	m.EncryptedContent, m.EncryptedKey = nil, nil
+	return nil
+}
+
+// Open decrypts a message sealed with Seal, or by a client predating envelopes
+func (m *Message) Open(key crypto.PrivateKey, room string) ([]byte, error) {
+	ad := m.AssociatedData(room)
+
+	if m.Envelope != nil {
+		padded, err := OpenEnvelope(m.Envelope, key, ad.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		return Unpad(padded)
+	}
+
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("legacy message needs an RSA private key")
+	}
+	return DecryptMessageWithAD(m.EncryptedContent, m.EncryptedKey, privateKey, ad)
+}
+
 // Packet is the wrapper for all communications between client and server
 type Packet struct {
-	Type      string      `json:"type"`
-	Data      interface{} `json:"data"`
-	Timestamp time.Time   `json:"timestamp"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data,omitempty"` // decode with Decode into the type's payload
+	Timestamp time.Time       `json:"timestamp"`
 }
 
 // FriendRequests represents a friendship request
@@ -72,6 +140,62 @@ type FriendRequests struct {
 type ServerConfig struct {
 	Host              string        `json:"host"`
 	Port              int           `json:"port"`
-	MessageTTL        time.Duration `json:"message_ttl"`
+	MessageTTL        time.Duration `json:"message_ttl"` // how long messages are held for offline recipients, negative to not hold them
 	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+
+	// Per-recipient limits on held messages, and on what one sender may hold
+	// for one recipient, 0 for the defaults
+	MaxQueuedMessages          int `json:"max_queued_messages,omitempty"`
+	MaxQueuedBytes             int `json:"max_queued_bytes,omitempty"`
+	MaxQueuedMessagesPerSender int `json:"max_queued_messages_per_sender,omitempty"`
+	MaxQueuedBytesPerSender    int `json:"max_queued_bytes_per_sender,omitempty"`
+
+	// Frames waiting to be written to one room member, 0 for the default, and
+	// what happens when they don't fit: QueuePolicyDisconnect (the default) or
+	// QueuePolicyDropOldest
+	SendQueueSize   int    `json:"send_queue_size,omitempty"`
+	SendQueuePolicy string `json:"send_queue_policy,omitempty"`
+
+	// How long a room member that dropped without saying goodbye keeps its
+	// slot for a resume, 0 for the default, negative to drop it at once
+	ResumeWindow time.Duration `json:"resume_window,omitempty"`
+
+	// Largest frame a client may send, bigger ones close the connection with
+	// code 1009. 0 for the default, negative for no limit.
+	MaxFrameSize int64 `json:"max_frame_size,omitempty"`
+
+	// Token bucket limits: frames per second with a burst allowance for each
+	// connection and for all connections from one IP, and room joins per IP.
+	// Going over closes the connection with code 1008. 0 for the defaults, a
+	// negative rate for no limit.
+	FrameRate    float64 `json:"frame_rate,omitempty"`
+	FrameBurst   int     `json:"frame_burst,omitempty"`
+	IPFrameRate  float64 `json:"ip_frame_rate,omitempty"`
+	IPFrameBurst int     `json:"ip_frame_burst,omitempty"`
+	JoinRate     float64 `json:"join_rate,omitempty"`
+	JoinBurst    int     `json:"join_burst,omitempty"`
+
+	// Connections open at once from one IP, 0 for the default, negative for no limit
+	MaxConnectionsPerIP int `json:"max_connections_per_ip,omitempty"`
+
+	// Browser origins, like https://chat.example.com, allowed to open a
+	// WebSocket besides the server's own. Clients that send no Origin, xtty
+	// itself among them, are always allowed.
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+
+	// Most members a room's creator may allow in it, 0 for the default,
+	// negative for no limit. Rooms hold 2 unless their creator asks for more.
+	MaxRoomMembers int `json:"max_room_members,omitempty"`
+
+	// How long a room waits for its first member, or for someone to come
+	// back once everyone left, and how long it lasts at most. 0 for the
+	// defaults, negative for no limit.
+	RoomJoinWindow time.Duration `json:"room_join_window,omitempty"`
+	RoomLifetime   time.Duration `json:"room_lifetime,omitempty"`
 }
+
+// What the relay does when a room member's send queue is full
+const (
+	QueuePolicyDisconnect = "disconnect"  // close the connection with code 1008
+	QueuePolicyDropOldest = "drop-oldest" // drop the oldest queued frame
+)
@@ -0,0 +1,256 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Subprotocol is offered by every xtty WebSocket, the server turns away
+// connections that don't offer it
+const Subprotocol = "xtty.v1"
+
+// Packet types understood by the server
+const (
+	PacketChallenge     = "challenge"
+	PacketAuth          = "auth"
+	PacketAuthOK        = "auth_ok"
+	PacketMessage       = "message"
+	PacketFriendRequest = "friend_request"
+	PacketStatus        = "status"
+	PacketReadReceipt   = "read_receipt"
+	PacketTyping        = "typing"
+	PacketAck           = "ack"
+	PacketError         = "error"
+)
+
+// Error codes carried by error packets
+const (
+	ErrCodeMalformed       = "malformed"       // not a packet, or Data doesn't fit the type's schema
+	ErrCodeInvalid         = "invalid"         // Data parsed but failed validation
+	ErrCodeUnknownType     = "unknown_type"    // no handler for the packet type
+	ErrCodeUnauthenticated = "unauthenticated" // the challenge wasn't answered with a valid signature
+	ErrCodeLocked          = "locked"          // too many failed logins, try again later
+	ErrCodeTimeout         = "timeout"         // the challenge wasn't answered in time
+	ErrCodeForbidden       = "forbidden"       // the packet claims to come from someone else
+	ErrCodeNotFound        = "not_found"       // the recipient or user doesn't exist
+	ErrCodeOffline         = "offline"         // the recipient isn't connected and the message can't be held for them
+	ErrCodeQuotaExceeded   = "quota_exceeded"  // the offline recipient has too many messages waiting
+	ErrCodeInternal        = "internal"
+)
+
+// Payload is the Data of a packet. Validate checks what JSON decoding can't.
+type Payload interface {
+	Validate() error
+}
+
+// NewPacket wraps a payload in a packet of the given type
+func NewPacket(packetType string, data Payload) (Packet, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Packet{}, err
+	}
+
+	return Packet{
+		Type:      packetType,
+		Data:      raw,
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// Decode unmarshals the packet's Data into payload and validates it. Unknown
+// fields are rejected so a misspelt field fails loudly instead of being dropped.
+// The error is an *ErrorPayload with code malformed or invalid.
+func (p Packet) Decode(payload Payload) error {
+	if len(p.Data) == 0 {
+		return &ErrorPayload{Code: ErrCodeMalformed, Message: "missing data", Packet: p.Type}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(p.Data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(payload); err != nil {
+		return &ErrorPayload{Code: ErrCodeMalformed, Message: err.Error(), Packet: p.Type}
+	}
+
+	if err := payload.Validate(); err != nil {
+		return &ErrorPayload{Code: ErrCodeInvalid, Message: err.Error(), Packet: p.Type}
+	}
+
+	return nil
+}
+
+// ErrorPayload reports why a packet was refused. It doubles as a Go error so
+// handlers can return one directly.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Packet  string `json:"packet,omitempty"` // type of the packet that caused the error
+}
+
+func (e *ErrorPayload) Error() string {
+	if e.Packet != "" {
+		return fmt.Sprintf("%s packet: %s: %s", e.Packet, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *ErrorPayload) Validate() error {
+	if e.Code == "" {
+		return errors.New("error code is required")
+	}
+	return nil
+}
+
+// ChallengeNonceSize is the length of the nonce in a challenge packet
+const ChallengeNonceSize = 32
+
+// ChallengePayload is sent by the server as soon as a packet connection opens
+type ChallengePayload struct {
+	Nonce []byte `json:"nonce"`
+}
+
+func (c *ChallengePayload) Validate() error {
+	if len(c.Nonce) != ChallengeNonceSize {
+		return fmt.Errorf("nonce must be %d bytes", ChallengeNonceSize)
+	}
+	return nil
+}
+
+// AuthPayload answers a challenge, proving the connection holds the private
+// key registered for the username
+type AuthPayload struct {
+	Username  string `json:"username"`
+	Signature []byte `json:"signature"` // over AuthChallengeMessage
+}
+
+func (a *AuthPayload) Validate() error {
+	if err := ValidateUsername(a.Username); err != nil {
+		return err
+	}
+	if len(a.Signature) == 0 {
+		return errors.New("signature is required")
+	}
+	return nil
+}
+
+// AuthChallengeMessage is what a client signs to answer a challenge. The
+// username is included so a signature can't be replayed for another account.
+func AuthChallengeMessage(username string, nonce []byte) []byte {
+	message, _ := json.Marshal([]interface{}{"xtty auth challenge", username, nonce})
+	return message
+}
+
+// AuthOKPayload confirms an auth packet
+type AuthOKPayload struct {
+	Username string `json:"username"`
+}
+
+func (a *AuthOKPayload) Validate() error {
+	return ValidateUsername(a.Username)
+}
+
+// Validate checks a message has an ID, both ends and either content or ciphertext
+func (m *Message) Validate() error {
+	if m.ID == "" {
+		return errors.New("message ID is required")
+	}
+	if err := ValidateUsername(m.SenderID); err != nil {
+		return fmt.Errorf("sender: %v", err)
+	}
+	if err := ValidateUsername(m.RecipientID); err != nil {
+		return fmt.Errorf("recipient: %v", err)
+	}
+	if m.Content == "" && m.EncryptedContent == nil && m.Envelope == nil {
+		return errors.New("message has no content")
+	}
+	return nil
+}
+
+func (f *FriendRequests) Validate() error {
+	if err := ValidateUsername(f.FromUser); err != nil {
+		return fmt.Errorf("from: %v", err)
+	}
+	if err := ValidateUsername(f.ToUser); err != nil {
+		return fmt.Errorf("to: %v", err)
+	}
+	if f.FromUser == f.ToUser {
+		return errors.New("can't befriend yourself")
+	}
+	return nil
+}
+
+// StatusPayload announces a user's presence
+type StatusPayload struct {
+	Username string     `json:"username"`
+	Status   UserStatus `json:"status"`
+}
+
+func (s *StatusPayload) Validate() error {
+	if err := ValidateUsername(s.Username); err != nil {
+		return err
+	}
+	if s.Status < StatusOffline || s.Status > StatusBusy {
+		return fmt.Errorf("unknown status %d", s.Status)
+	}
+	return nil
+}
+
+// ReadReceiptPayload tells a message's sender it was read
+type ReadReceiptPayload struct {
+	MessageID string    `json:"message_id"`
+	From      string    `json:"from"` // the reader
+	To        string    `json:"to"`   // the message's sender
+	ReadAt    time.Time `json:"read_at"`
+}
+
+func (r *ReadReceiptPayload) Validate() error {
+	if r.MessageID == "" {
+		return errors.New("message ID is required")
+	}
+	if err := ValidateUsername(r.From); err != nil {
+		return fmt.Errorf("from: %v", err)
+	}
+	return ValidateUsername(r.To)
+}
+
+// TypingPayload tells a user someone started or stopped typing to them
+type TypingPayload struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Typing bool   `json:"typing"`
+}
+
+func (t *TypingPayload) Validate() error {
+	if err := ValidateUsername(t.From); err != nil {
+		return fmt.Errorf("from: %v", err)
+	}
+	return ValidateUsername(t.To)
+}
+
+// AckPayload confirms a message arrived, so the server can stop holding it
+type AckPayload struct {
+	MessageID string `json:"message_id"`
+	From      string `json:"from"` // the message's sender
+}
+
+func (a *AckPayload) Validate() error {
+	if a.MessageID == "" {
+		return errors.New("message ID is required")
+	}
+	return ValidateUsername(a.From)
+}
+
+// ValidateUsername refuses names packets can't carry: empty ones and ones
+// with whitespace
+func ValidateUsername(username string) error {
+	if username == "" {
+		return errors.New("username is required")
+	}
+	if strings.ContainsAny(username, " \t\r\n") {
+		return fmt.Errorf("invalid username %q", username)
+	}
+	return nil
+}
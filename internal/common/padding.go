@@ -0,0 +1,49 @@
+package common
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// MinPaddedLength is the smallest padded size, so short chat lines all look alike
+const MinPaddedLength = 64
+
+// paddingMarker ends the payload, everything after it is zeros
+const paddingMarker = 0x80
+
+// PaddedLength returns the bucket a payload of n bytes is padded to. Above
+// MinPaddedLength buckets follow Padmé: lengths are rounded so only the top
+// few bits vary, which leaks O(log log n) bits and costs at most ~12% overhead.
+func PaddedLength(n int) int {
+	if n <= MinPaddedLength {
+		return MinPaddedLength
+	}
+
+	e := bits.Len(uint(n)) - 1 // floor(log2(n))
+	s := bits.Len(uint(e))     // floor(log2(e)) + 1
+	lastBits := e - s
+	mask := 1<<lastBits - 1
+	return (n + mask) &^ mask
+}
+
+// Pad appends a marker byte and zeros to reach the payload's bucket
+func Pad(payload []byte) []byte {
+	padded := make([]byte, PaddedLength(len(payload)+1))
+	copy(padded, payload)
+	padded[len(payload)] = paddingMarker
+	return padded
+}
+
+// Unpad strips the padding added by Pad
+func Unpad(padded []byte) ([]byte, error) {
+	for i := len(padded) - 1; i >= 0; i-- {
+		if padded[i] == 0 {
+			continue
+		}
+		if padded[i] == paddingMarker {
+			return padded[:i], nil
+		}
+		break
+	}
+	return nil, errors.New("invalid padding")
+}
@@ -0,0 +1,48 @@
+package common_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+func TestPaddingRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 5, 63, 64, 100, 1000, 4097} {
+		payload := bytes.Repeat([]byte{0}, n) // trailing zeros must survive
+		padded := common.Pad(payload)
+
+		if len(padded) != common.PaddedLength(n+1) {
+			t.Errorf("Pad(%d bytes) gave %d bytes, want %d", n, len(padded), common.PaddedLength(n+1))
+		}
+
+		unpadded, err := common.Unpad(padded)
+		if err != nil {
+			t.Fatalf("Failed to unpad %d bytes: %v", n, err)
+		}
+		if !bytes.Equal(unpadded, payload) {
+			t.Errorf("Unpadded %d bytes don't match the original", n)
+		}
+	}
+
+	if _, err := common.Unpad(make([]byte, 64)); err == nil {
+		t.Error("Unpad accepted a payload without a marker")
+	}
+}
+
+func TestPaddedLengthBuckets(t *testing.T) {
+	// Short chat lines all share the minimum bucket
+	if common.PaddedLength(1) != common.PaddedLength(common.MinPaddedLength) {
+		t.Error("Short payloads should share the minimum bucket")
+	}
+
+	for n := 1; n < 100000; n += 7 {
+		padded := common.PaddedLength(n)
+		if padded < n {
+			t.Fatalf("PaddedLength(%d) = %d is shorter than the payload", n, padded)
+		}
+		if n > common.MinPaddedLength && float64(padded-n)/float64(n) > 0.12 {
+			t.Fatalf("PaddedLength(%d) = %d adds more than 12%%", n, padded)
+		}
+	}
+}
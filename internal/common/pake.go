@@ -0,0 +1,118 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+
+	"filippo.io/edwards25519"
+)
+
+var pakeSeed = []byte("xtty spake2 symmetric element")
+
+// symmetricElement is the SPAKE2 blinding point S. It is hashed to the curve
+// so nobody knows its discrete log.
+var symmetricElement = hashToPoint(pakeSeed)
+
+// PAKE is one side of a symmetric SPAKE2 exchange over edwards25519.
+// Both sides derive the same key only if they used the same password, and a
+// man in the middle gets a single online guess per exchange.
+type PAKE struct {
+	password *edwards25519.Scalar
+	secret   *edwards25519.Scalar
+	message  []byte
+}
+
+// NewPAKE starts an exchange for the given password
+func NewPAKE(password []byte) (*PAKE, error) {
+	w := passwordScalar(password)
+
+	random := make([]byte, 64)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	x, err := edwards25519.NewScalar().SetUniformBytes(random)
+	if err != nil {
+		return nil, err
+	}
+
+	// X = x*G + w*S
+	blind := new(edwards25519.Point).ScalarMult(w, symmetricElement)
+	element := new(edwards25519.Point).ScalarBaseMult(x)
+	element.Add(element, blind)
+
+	return &PAKE{
+		password: w,
+		secret:   x,
+		message:  element.Bytes(),
+	}, nil
+}
+
+// Message is the element to send to the peer
+func (p *PAKE) Message() []byte {
+	return p.message
+}
+
+// Finish combines the peer's element with ours and returns the 32 byte shared key
+func (p *PAKE) Finish(peerMessage []byte) ([]byte, error) {
+	if bytes.Equal(peerMessage, p.message) {
+		return nil, errors.New("pake: peer reflected our message")
+	}
+
+	peer, err := new(edwards25519.Point).SetBytes(peerMessage)
+	if err != nil {
+		return nil, errors.New("pake: invalid peer message")
+	}
+
+	// K = 8 * x * (Y - w*S)
+	blind := new(edwards25519.Point).ScalarMult(p.password, symmetricElement)
+	shared := new(edwards25519.Point).Subtract(peer, blind)
+	shared.ScalarMult(p.secret, shared)
+	shared.MultByCofactor(shared)
+	if shared.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, errors.New("pake: invalid peer message")
+	}
+
+	// Both sides hash the same transcript, so order the elements
+	first, second := p.message, peerMessage
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+
+	transcript := sha256.New()
+	transcript.Write(pakeSeed)
+	transcript.Write(first)
+	transcript.Write(second)
+	transcript.Write(shared.Bytes())
+	transcript.Write(p.password.Bytes())
+
+	return transcript.Sum(nil), nil
+}
+
+func passwordScalar(password []byte) *edwards25519.Scalar {
+	digest := sha512.Sum512(append([]byte("xtty spake2 password"), password...))
+	w, _ := edwards25519.NewScalar().SetUniformBytes(digest[:])
+	return w
+}
+
+// Tries successive hashes of the seed until one decodes to a point of large order
+func hashToPoint(seed []byte) *edwards25519.Point {
+	for counter := uint32(0); ; counter++ {
+		digest := sha256.Sum256(binary.BigEndian.AppendUint32(bytes.Clone(seed), counter))
+
+		point, err := new(edwards25519.Point).SetBytes(digest[:])
+		if err != nil {
+			continue
+		}
+
+		point.MultByCofactor(point)
+		if point.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+
+		return point
+	}
+}
@@ -0,0 +1,57 @@
+package common_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+func runPAKE(t *testing.T, passwordA, passwordB string) ([]byte, []byte) {
+	t.Helper()
+
+	alice, err := common.NewPAKE([]byte(passwordA))
+	if err != nil {
+		t.Fatalf("Failed to start PAKE: %v", err)
+	}
+	bob, err := common.NewPAKE([]byte(passwordB))
+	if err != nil {
+		t.Fatalf("Failed to start PAKE: %v", err)
+	}
+
+	aliceKey, err := alice.Finish(bob.Message())
+	if err != nil {
+		t.Fatalf("Failed to finish PAKE: %v", err)
+	}
+	bobKey, err := bob.Finish(alice.Message())
+	if err != nil {
+		t.Fatalf("Failed to finish PAKE: %v", err)
+	}
+
+	return aliceKey, bobKey
+}
+
+func TestPAKESamePassword(t *testing.T) {
+	aliceKey, bobKey := runPAKE(t, "7B3X9P", "7B3X9P")
+	if !bytes.Equal(aliceKey, bobKey) {
+		t.Errorf("Keys differ for the same password")
+	}
+}
+
+func TestPAKEWrongPassword(t *testing.T) {
+	aliceKey, bobKey := runPAKE(t, "7B3X9P", "7B3X9Q")
+	if bytes.Equal(aliceKey, bobKey) {
+		t.Errorf("Keys match for different passwords")
+	}
+}
+
+func TestPAKERejectsReflection(t *testing.T) {
+	alice, err := common.NewPAKE([]byte("7B3X9P"))
+	if err != nil {
+		t.Fatalf("Failed to start PAKE: %v", err)
+	}
+
+	if _, err := alice.Finish(alice.Message()); err == nil {
+		t.Errorf("Reflected message should be rejected")
+	}
+}
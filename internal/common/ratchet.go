@@ -0,0 +1,321 @@
+package common
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+)
+
+const (
+	// MaxSkippedMessages is the most message keys a single header may make us skip
+	MaxSkippedMessages = 1000
+	// maxSkippedKeyCache bounds the total number of stored out-of-order message keys
+	maxSkippedKeyCache = 2000
+)
+
+var (
+	rootKeyInfo    = []byte("xtty ratchet root")
+	messageKeyInfo = []byte("xtty ratchet message key")
+)
+
+// RatchetHeader travels in the clear next to every ratcheted ciphertext
+type RatchetHeader struct {
+	DH []byte `json:"dh"` // sender's current ratchet public key
+	PN uint32 `json:"pn"` // number of messages in the sender's previous sending chain
+	N  uint32 `json:"n"`  // message number in the current sending chain
+}
+
+// Encodes the header so it can be authenticated as associated data
+func (h RatchetHeader) bytes() []byte {
+	b := make([]byte, 0, len(h.DH)+8)
+	b = append(b, h.DH...)
+	b = binary.BigEndian.AppendUint32(b, h.PN)
+	b = binary.BigEndian.AppendUint32(b, h.N)
+	return b
+}
+
+type skippedKey struct {
+	dh string
+	n  uint32
+}
+
+// ratchetState is everything a Ratchet mutates while decrypting, so a failed
+// decryption can be thrown away without corrupting the session
+type ratchetState struct {
+	dhSelf       *ecdh.PrivateKey
+	dhPeer       *ecdh.PublicKey
+	rootKey      []byte
+	sendChain    []byte
+	recvChain    []byte
+	sendN        uint32
+	recvN        uint32
+	prevN        uint32
+	skipped      map[skippedKey][]byte
+	skippedOrder []skippedKey
+}
+
+func (s *ratchetState) clone() *ratchetState {
+	c := *s
+	c.skipped = maps.Clone(s.skipped)
+	c.skippedOrder = slices.Clone(s.skippedOrder)
+	return &c
+}
+
+// Ratchet is a Double Ratchet session between two X25519 parties.
+// Every message gets a fresh key from a symmetric chain, and the chains are
+// re-keyed with a new Diffie-Hellman exchange each time the conversation turns
+// around, so a compromised key cannot decrypt earlier traffic.
+type Ratchet struct {
+	mu    sync.Mutex
+	suite CipherSuite // supplies the AEAD that message keys are used with
+	state *ratchetState
+}
+
+// NewRatchet starts a session from a shared root key and the handshake keys
+// both sides exchanged. Either side may send first; roles are derived from
+// the ordering of the two public keys. Messages are sealed with AES-256-GCM.
+func NewRatchet(rootKey []byte, ours *ecdh.PrivateKey, peer *ecdh.PublicKey) (*Ratchet, error) {
+	suite, err := LookupCipherSuite(LegacyCipherSuite)
+	if err != nil {
+		return nil, err
+	}
+	return NewRatchetWithSuite(suite, rootKey, ours, peer)
+}
+
+// NewRatchetWithSuite is NewRatchet sealing messages with the suite's AEAD
+func NewRatchetWithSuite(suite CipherSuite, rootKey []byte, ours *ecdh.PrivateKey, peer *ecdh.PublicKey) (*Ratchet, error) {
+	cmp := bytes.Compare(ours.PublicKey().Bytes(), peer.Bytes())
+	if cmp == 0 {
+		return nil, errors.New("ratchet: peer key equals our own key")
+	}
+
+	keys := DeriveKey(rootKey, nil, rootKeyInfo, 64)
+	state := &ratchetState{
+		dhSelf:  ours,
+		dhPeer:  peer,
+		rootKey: keys[:32],
+		skipped: make(map[skippedKey][]byte),
+	}
+
+	if cmp < 0 {
+		// Initiator: ratchet forward straight away so our first messages
+		// already use a key the peer has never seen
+		state.recvChain = keys[32:]
+
+		dhSelf, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		state.dhSelf = dhSelf
+
+		state.rootKey, state.sendChain, err = kdfRootKey(state.rootKey, dhSelf, peer)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Responder: send on the initial chain until the initiator's first
+		// ratchet key shows up
+		state.sendChain = keys[32:]
+	}
+
+	return &Ratchet{suite: suite, state: state}, nil
+}
+
+// Encrypt seals a message with the next sending key. ad is authenticated but not encrypted.
+func (r *Ratchet) Encrypt(plaintext, ad []byte) (RatchetHeader, []byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.state
+	header := RatchetHeader{
+		DH: s.dhSelf.PublicKey().Bytes(),
+		PN: s.prevN,
+		N:  s.sendN,
+	}
+
+	var messageKey []byte
+	messageKey, s.sendChain = kdfChainKey(s.sendChain)
+	s.sendN++
+
+	ciphertext, err := r.sealMessageKey(messageKey, plaintext, append(slices.Clone(ad), header.bytes()...))
+	if err != nil {
+		return RatchetHeader{}, nil, err
+	}
+
+	return header, ciphertext, nil
+}
+
+// Decrypt opens a ratcheted message, accepting out-of-order delivery as long
+// as the message key is still in the skipped-key cache
+func (r *Ratchet) Decrypt(header RatchetHeader, ciphertext, ad []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ad = append(slices.Clone(ad), header.bytes()...)
+	s := r.state.clone()
+
+	// Message from a chain we already skipped past
+	key := skippedKey{dh: string(header.DH), n: header.N}
+	if messageKey, ok := s.skipped[key]; ok {
+		plaintext, err := r.openMessageKey(messageKey, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		s.forgetSkipped(key)
+		r.state = s
+		return plaintext, nil
+	}
+
+	// Peer turned the conversation around, advance the DH ratchet
+	if !bytes.Equal(header.DH, s.dhPeer.Bytes()) {
+		if err := s.skipMessageKeys(header.PN); err != nil {
+			return nil, err
+		}
+		if err := s.dhRatchet(header); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keys are deleted once used, so an old number on the current chain is a replay
+	if header.N < s.recvN {
+		return nil, ErrReplayedMessage
+	}
+	if err := s.skipMessageKeys(header.N); err != nil {
+		return nil, err
+	}
+
+	var messageKey []byte
+	messageKey, s.recvChain = kdfChainKey(s.recvChain)
+	s.recvN++
+
+	plaintext, err := r.openMessageKey(messageKey, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	r.state = s
+	return plaintext, nil
+}
+
+// Stores the keys for messages up to (not including) until on the current receiving chain
+func (s *ratchetState) skipMessageKeys(until uint32) error {
+	if s.recvChain == nil {
+		return nil
+	}
+	if until > s.recvN && until-s.recvN > MaxSkippedMessages {
+		return errors.New("ratchet: too many skipped messages")
+	}
+
+	for s.recvN < until {
+		var messageKey []byte
+		messageKey, s.recvChain = kdfChainKey(s.recvChain)
+
+		key := skippedKey{dh: string(s.dhPeer.Bytes()), n: s.recvN}
+		s.skipped[key] = messageKey
+		s.skippedOrder = append(s.skippedOrder, key)
+		s.recvN++
+	}
+
+	// Evict the oldest keys once the cache is full
+	for len(s.skippedOrder) > maxSkippedKeyCache {
+		delete(s.skipped, s.skippedOrder[0])
+		s.skippedOrder = s.skippedOrder[1:]
+	}
+
+	return nil
+}
+
+func (s *ratchetState) forgetSkipped(key skippedKey) {
+	delete(s.skipped, key)
+	if i := slices.Index(s.skippedOrder, key); i >= 0 {
+		s.skippedOrder = slices.Delete(s.skippedOrder, i, i+1)
+	}
+}
+
+func (s *ratchetState) dhRatchet(header RatchetHeader) error {
+	peer, err := ecdh.X25519().NewPublicKey(header.DH)
+	if err != nil {
+		return err
+	}
+
+	s.prevN = s.sendN
+	s.sendN = 0
+	s.recvN = 0
+	s.dhPeer = peer
+
+	s.rootKey, s.recvChain, err = kdfRootKey(s.rootKey, s.dhSelf, s.dhPeer)
+	if err != nil {
+		return err
+	}
+
+	s.dhSelf, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	s.rootKey, s.sendChain, err = kdfRootKey(s.rootKey, s.dhSelf, s.dhPeer)
+	return err
+}
+
+// Mixes a fresh DH output into the root key, returning the new root and chain keys
+func kdfRootKey(rootKey []byte, self *ecdh.PrivateKey, peer *ecdh.PublicKey) ([]byte, []byte, error) {
+	shared, err := self.ECDH(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := DeriveKey(shared, rootKey, rootKeyInfo, 64)
+	return keys[:32], keys[32:], nil
+}
+
+// Steps a symmetric chain, returning the message key and the next chain key
+func kdfChainKey(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	messageKey := mac.Sum(nil)
+
+	mac.Reset()
+	mac.Write([]byte{0x02})
+	return messageKey, mac.Sum(nil)
+}
+
+// Each message key is used once, so the nonce can be derived alongside it
+func (r *Ratchet) messageAEAD(messageKey []byte) (cipher.AEAD, []byte, error) {
+	keys := DeriveKey(messageKey, nil, messageKeyInfo, 32+12)
+
+	aead, err := r.suite.NewAEAD(keys[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	if aead.NonceSize() != 12 {
+		return nil, nil, errors.New("ratchet: unsupported nonce size")
+	}
+
+	return aead, keys[32:], nil
+}
+
+func (r *Ratchet) sealMessageKey(messageKey, plaintext, ad []byte) ([]byte, error) {
+	aead, nonce, err := r.messageAEAD(messageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func (r *Ratchet) openMessageKey(messageKey, ciphertext, ad []byte) ([]byte, error) {
+	aead, nonce, err := r.messageAEAD(messageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
@@ -0,0 +1,121 @@
+package common_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+// Sets up two ratchets that share a root key, as the client does after key exchange
+func newRatchetPair(t *testing.T) (*common.Ratchet, *common.Ratchet) {
+	t.Helper()
+
+	aliceKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	bobKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	rootKey := make([]byte, 32)
+	rand.Read(rootKey)
+
+	alice, err := common.NewRatchet(rootKey, aliceKey, bobKey.PublicKey())
+	if err != nil {
+		t.Fatalf("Failed to create ratchet: %v", err)
+	}
+	bob, err := common.NewRatchet(rootKey, bobKey, aliceKey.PublicKey())
+	if err != nil {
+		t.Fatalf("Failed to create ratchet: %v", err)
+	}
+
+	return alice, bob
+}
+
+func TestRatchetConversation(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("room")
+
+	// Both sides talk in turn, each turn triggers a DH ratchet step
+	turns := []struct {
+		from, to *common.Ratchet
+		text     string
+	}{
+		{bob, alice, "hi alice"},
+		{alice, bob, "hi bob"},
+		{alice, bob, "how are you?"},
+		{bob, alice, "fine"},
+	}
+
+	for _, turn := range turns {
+		header, ciphertext, err := turn.from.Encrypt([]byte(turn.text), ad)
+		if err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+
+		plaintext, err := turn.to.Decrypt(header, ciphertext, ad)
+		if err != nil {
+			t.Fatalf("Failed to decrypt %q: %v", turn.text, err)
+		}
+		if string(plaintext) != turn.text {
+			t.Errorf("Decrypted %q, want %q", plaintext, turn.text)
+		}
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	type sealed struct {
+		header     common.RatchetHeader
+		ciphertext []byte
+	}
+
+	var messages []sealed
+	for _, text := range []string{"one", "two", "three"} {
+		header, ciphertext, err := alice.Encrypt([]byte(text), nil)
+		if err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+		messages = append(messages, sealed{header, ciphertext})
+	}
+
+	// Deliver the last message first, the skipped ones must still open
+	for _, i := range []int{2, 0, 1} {
+		if _, err := bob.Decrypt(messages[i].header, messages[i].ciphertext, nil); err != nil {
+			t.Fatalf("Failed to decrypt message %d: %v", i, err)
+		}
+	}
+
+	// Replaying a message must fail since its key has been used
+	if _, err := bob.Decrypt(messages[0].header, messages[0].ciphertext, nil); err == nil {
+		t.Errorf("Replayed message should not decrypt")
+	}
+}
+
+func TestRatchetTamperedMessage(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	header, ciphertext, err := alice.Encrypt([]byte("original"), []byte("room"))
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+
+	// Wrong associated data
+	if _, err := bob.Decrypt(header, ciphertext, []byte("other room")); err == nil {
+		t.Errorf("Decryption with wrong associated data should fail")
+	}
+
+	// A failed decryption must not break the session
+	plaintext, err := bob.Decrypt(header, ciphertext, []byte("room"))
+	if err != nil {
+		t.Fatalf("Failed to decrypt after rejected message: %v", err)
+	}
+	if string(plaintext) != "original" {
+		t.Errorf("Decrypted %q, want %q", plaintext, "original")
+	}
+}
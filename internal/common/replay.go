@@ -0,0 +1,178 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultReplayWindow is how far behind the newest counter a message may arrive
+const DefaultReplayWindow = 64
+
+var (
+	// ErrReplayedMessage means a message with this counter was already accepted
+	ErrReplayedMessage = errors.New("replayed message")
+	// ErrMessageTooOld means the message was reordered further back than the window allows
+	ErrMessageTooOld = errors.New("message too old for the replay window")
+)
+
+// ReplayError reports a message rejected by a ReplayGuard. It unwraps to
+// ErrReplayedMessage or ErrMessageTooOld.
+type ReplayError struct {
+	Sender  string
+	Counter uint64
+	Err     error
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("message %d from %s rejected: %v", e.Counter, e.Sender, e.Err)
+}
+
+func (e *ReplayError) Unwrap() error {
+	return e.Err
+}
+
+// AssociatedData is authenticated together with a ciphertext but not
+// encrypted, so a ciphertext can't be moved to another room, sender or
+// recipient, or be re-sent under a different counter
+type AssociatedData struct {
+	Room      string
+	Sender    string
+	Recipient string
+	MessageID string
+	Counter   uint64 // increases by one for every message from Sender to Recipient
+	Epoch     uint32 // key epoch the message was sealed under
+	Padded    bool   // the plaintext is a padded payload, not the bare message
+}
+
+// Bytes encodes the associated data unambiguously, each field length-prefixed
+func (ad AssociatedData) Bytes() []byte {
+	b := []byte("xtty ad v2")
+	for _, field := range []string{ad.Room, ad.Sender, ad.Recipient, ad.MessageID} {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(field)))
+		b = append(b, field...)
+	}
+	b = binary.BigEndian.AppendUint64(b, ad.Counter)
+	b = binary.BigEndian.AppendUint32(b, ad.Epoch)
+	if ad.Padded {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// The replay state of one room/sender/recipient stream
+type stream struct {
+	room, sender, recipient string
+}
+
+type replayWindow struct {
+	highest uint64
+	seen    []uint64 // bit i set when highest-i was accepted
+}
+
+// ReplayGuard tracks the counters received on every stream and rejects
+// duplicates and messages that fall behind the sliding window
+type ReplayGuard struct {
+	size    uint64
+	windows map[stream]*replayWindow
+	mu      sync.Mutex
+}
+
+// NewReplayGuard creates a guard accepting messages up to size counters behind the newest
+func NewReplayGuard(size int) *ReplayGuard {
+	if size <= 0 {
+		size = DefaultReplayWindow
+	}
+
+	return &ReplayGuard{
+		size:    uint64(size),
+		windows: make(map[stream]*replayWindow),
+	}
+}
+
+// Check reports whether a message would be accepted, without recording it.
+// Call it before decrypting so obvious replays cost nothing.
+func (g *ReplayGuard) Check(ad AssociatedData) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.check(ad)
+}
+
+// Accept records a message as received. Only call it once the message has
+// been authenticated, so forgeries can't advance the window.
+func (g *ReplayGuard) Accept(ad AssociatedData) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.check(ad); err != nil {
+		return err
+	}
+
+	key := stream{ad.Room, ad.Sender, ad.Recipient}
+	window, ok := g.windows[key]
+	if !ok {
+		window = &replayWindow{seen: make([]uint64, (g.size+63)/64)}
+		g.windows[key] = window
+	}
+
+	if ad.Counter > window.highest {
+		window.shift(ad.Counter - window.highest)
+		window.highest = ad.Counter
+	}
+	window.mark(window.highest - ad.Counter)
+
+	return nil
+}
+
+// Reset forgets a stream, for when its sender starts a new session and counts from zero again
+func (g *ReplayGuard) Reset(room, sender, recipient string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.windows, stream{room, sender, recipient})
+}
+
+func (g *ReplayGuard) check(ad AssociatedData) error {
+	window, ok := g.windows[stream{ad.Room, ad.Sender, ad.Recipient}]
+	if !ok || ad.Counter > window.highest {
+		return nil
+	}
+
+	offset := window.highest - ad.Counter
+	switch {
+	case offset >= g.size:
+		return &ReplayError{Sender: ad.Sender, Counter: ad.Counter, Err: ErrMessageTooOld}
+	case window.marked(offset):
+		return &ReplayError{Sender: ad.Sender, Counter: ad.Counter, Err: ErrReplayedMessage}
+	}
+
+	return nil
+}
+
+// Moves the window forward by n counters
+func (w *replayWindow) shift(n uint64) {
+	bits := uint64(len(w.seen)) * 64
+	if n >= bits {
+		clear(w.seen)
+		return
+	}
+
+	for ; n > 0; n-- {
+		var carry uint64
+		for i := range w.seen {
+			next := w.seen[i] >> 63
+			w.seen[i] = w.seen[i]<<1 | carry
+			carry = next
+		}
+	}
+}
+
+func (w *replayWindow) mark(offset uint64) {
+	w.seen[offset/64] |= 1 << (offset % 64)
+}
+
+func (w *replayWindow) marked(offset uint64) bool {
+	return w.seen[offset/64]&(1<<(offset%64)) != 0
+}
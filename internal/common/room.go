@@ -0,0 +1,34 @@
+package common
+
+import "time"
+
+// CreateRoomRequest is posted to /rooms to mint a room
+type CreateRoomRequest struct {
+	Members int  `json:"members,omitempty"` // how many it may hold, 0 for the server's default
+	Channel bool `json:"channel,omitempty"` // a short number easy to read out, instead of an unguessable ID
+}
+
+// CreateRoomResponse names the new room. Room is only the routing part of a
+// room code, the password part is made by the client and never sent.
+type CreateRoomResponse struct {
+	Room       string    `json:"room"`
+	OwnerToken string    `json:"owner_token"` // join with it to own the room
+	JoinBy     time.Time `json:"join_by"`     // the room is dropped if nobody has joined by then
+	Closes     time.Time `json:"closes"`      // the room is closed then no matter what
+}
+
+// Reasons the relay gives when it closes a room connection with code 1008
+// and won't take the client back. Clients don't reconnect after these.
+const (
+	RoomRefusedUnknown = "no such room, it may have expired"
+	RoomRefusedExpired = "room expired"
+	RoomRefusedFull    = "room is full"
+	RoomRefusedLocked  = "room is locked"
+	RoomRefusedBanned  = "banned from this room"
+	RoomRefusedKicked  = "kicked from the room"
+)
+
+// RoomRefusedNoOwner closes a join to a channel room its creator hasn't
+// joined yet, so nobody who guessed the number can take the slots first.
+// Unlike the reasons above it doesn't last, clients try again.
+const RoomRefusedNoOwner = "waiting for the room's creator to join"
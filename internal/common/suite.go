@@ -0,0 +1,355 @@
+package common
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// SuiteID names a set of algorithms used to protect or sign a payload
+type SuiteID string
+
+const (
+	// SuiteRSAOAEPAESGCM is the original hybrid scheme: RSA-OAEP wraps an AES-256-GCM key
+	SuiteRSAOAEPAESGCM SuiteID = "rsa-oaep-sha256+aes-256-gcm"
+	// SuiteX25519ChaCha20Poly1305 seals to an X25519 key with an ephemeral ECDH and ChaCha20-Poly1305
+	SuiteX25519ChaCha20Poly1305 SuiteID = "x25519+chacha20-poly1305"
+
+	// SuiteRSAPKCS1v15SHA256 is the original RSA signature scheme
+	SuiteRSAPKCS1v15SHA256 SuiteID = "rsa-pkcs1v15-sha256"
+	// SuiteEd25519 signs with Ed25519
+	SuiteEd25519 SuiteID = "ed25519"
+)
+
+// LegacyCipherSuite is assumed for peers and messages that don't name a suite
+const LegacyCipherSuite = SuiteRSAOAEPAESGCM
+
+// EnvelopeVersion is the current Envelope format
+const EnvelopeVersion = 1
+
+// CipherSuite encrypts payloads, either to a recipient's public key or, via
+// NewAEAD, with a symmetric key agreed some other way
+type CipherSuite interface {
+	ID() SuiteID
+	NewAEAD(key []byte) (cipher.AEAD, error)
+	Seal(recipient crypto.PublicKey, plaintext, ad []byte) ([]byte, error)
+	Open(key crypto.PrivateKey, payload, ad []byte) ([]byte, error)
+}
+
+// SignatureSuite signs and verifies messages
+type SignatureSuite interface {
+	ID() SuiteID
+	Sign(key crypto.Signer, message []byte) ([]byte, error)
+	Verify(key crypto.PublicKey, message, signature []byte) error
+}
+
+// Suites register in preference order, most preferred first
+var (
+	suitesMu        sync.RWMutex
+	cipherSuites    []CipherSuite
+	signatureSuites []SignatureSuite
+)
+
+func init() {
+	RegisterCipherSuite(x25519ChaChaSuite{})
+	RegisterCipherSuite(rsaOAEPSuite{})
+	RegisterSignatureSuite(ed25519Suite{})
+	RegisterSignatureSuite(rsaPKCS1Suite{})
+}
+
+// RegisterCipherSuite adds a cipher suite, less preferred than those registered before it
+func RegisterCipherSuite(suite CipherSuite) {
+	suitesMu.Lock()
+	defer suitesMu.Unlock()
+	cipherSuites = append(cipherSuites, suite)
+}
+
+// RegisterSignatureSuite adds a signature suite
+func RegisterSignatureSuite(suite SignatureSuite) {
+	suitesMu.Lock()
+	defer suitesMu.Unlock()
+	signatureSuites = append(signatureSuites, suite)
+}
+
+// LookupCipherSuite finds a registered cipher suite, the empty ID meaning the legacy one
+func LookupCipherSuite(id SuiteID) (CipherSuite, error) {
+	if id == "" {
+		id = LegacyCipherSuite
+	}
+
+	suitesMu.RLock()
+	defer suitesMu.RUnlock()
+	for _, suite := range cipherSuites {
+		if suite.ID() == id {
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported cipher suite %q", id)
+}
+
+// LookupSignatureSuite finds a registered signature suite, the empty ID meaning RSA
+func LookupSignatureSuite(id SuiteID) (SignatureSuite, error) {
+	if id == "" {
+		id = SuiteRSAPKCS1v15SHA256
+	}
+
+	suitesMu.RLock()
+	defer suitesMu.RUnlock()
+	for _, suite := range signatureSuites {
+		if suite.ID() == id {
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported signature suite %q", id)
+}
+
+// SupportedCipherSuites lists the registered cipher suites, most preferred first
+func SupportedCipherSuites() []SuiteID {
+	suitesMu.RLock()
+	defer suitesMu.RUnlock()
+
+	ids := make([]SuiteID, 0, len(cipherSuites))
+	for _, suite := range cipherSuites {
+		ids = append(ids, suite.ID())
+	}
+	return ids
+}
+
+// NegotiateCipherSuite picks the most preferred suite both sides support.
+// Preference follows registration order, so both peers pick the same one.
+// A peer that offers nothing predates negotiation and gets the legacy suite.
+func NegotiateCipherSuite(offered []SuiteID) (CipherSuite, error) {
+	if len(offered) == 0 {
+		return LookupCipherSuite(LegacyCipherSuite)
+	}
+
+	for _, id := range SupportedCipherSuites() {
+		if slices.Contains(offered, id) {
+			return LookupCipherSuite(id)
+		}
+	}
+	return nil, errors.New("no cipher suite in common with peer")
+}
+
+// SignatureSuiteForKey returns the suite that signs with the given public key's algorithm
+func SignatureSuiteForKey(key crypto.PublicKey) (SuiteID, error) {
+	switch key.(type) {
+	case ed25519.PublicKey:
+		return SuiteEd25519, nil
+	case *rsa.PublicKey:
+		return SuiteRSAPKCS1v15SHA256, nil
+	default:
+		return "", fmt.Errorf("no signature suite for %T", key)
+	}
+}
+
+// Envelope is the versioned wrapper naming how its payload was protected
+type Envelope struct {
+	Version int     `json:"v"`
+	Suite   SuiteID `json:"suite"`
+	KeyID   string  `json:"kid,omitempty"` // fingerprint of the recipient key
+	Payload []byte  `json:"payload"`
+}
+
+// SealEnvelope encrypts plaintext to the recipient with the given suite
+func SealEnvelope(id SuiteID, recipient crypto.PublicKey, keyID string, plaintext, ad []byte) (*Envelope, error) {
+	suite, err := LookupCipherSuite(id)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := suite.Seal(recipient, plaintext, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		Version: EnvelopeVersion,
+		Suite:   suite.ID(),
+		KeyID:   keyID,
+		Payload: payload,
+	}, nil
+}
+
+// OpenEnvelope decrypts an envelope with the recipient's private key
+func OpenEnvelope(envelope *Envelope, key crypto.PrivateKey, ad []byte) ([]byte, error) {
+	if envelope.Version > EnvelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", envelope.Version)
+	}
+
+	suite, err := LookupCipherSuite(envelope.Suite)
+	if err != nil {
+		return nil, err
+	}
+
+	return suite.Open(key, envelope.Payload, ad)
+}
+
+// rsaOAEPSuite is EncryptMessage/DecryptMessage packed into a single payload:
+// a 2 byte length, the wrapped key, then the AES-GCM ciphertext
+type rsaOAEPSuite struct{}
+
+func (rsaOAEPSuite) ID() SuiteID { return SuiteRSAOAEPAESGCM }
+
+func (rsaOAEPSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return newAESGCM(key)
+}
+
+func (rsaOAEPSuite) Seal(recipient crypto.PublicKey, plaintext, ad []byte) ([]byte, error) {
+	publicKey, ok := recipient.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s needs an RSA key, got %T", SuiteRSAOAEPAESGCM, recipient)
+	}
+
+	encryptedMessage, encryptedKey, err := encryptHybrid(plaintext, publicKey, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(encryptedKey)))
+	payload = append(payload, encryptedKey...)
+	return append(payload, encryptedMessage...), nil
+}
+
+func (rsaOAEPSuite) Open(key crypto.PrivateKey, payload, ad []byte) ([]byte, error) {
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s needs an RSA key, got %T", SuiteRSAOAEPAESGCM, key)
+	}
+
+	if len(payload) < 2 {
+		return nil, errors.New("payload too short")
+	}
+	keyLength := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+keyLength {
+		return nil, errors.New("payload too short")
+	}
+
+	return decryptHybrid(payload[2+keyLength:], payload[2:2+keyLength], privateKey, ad)
+}
+
+// x25519ChaChaSuite seals to an X25519 key: the payload is an ephemeral
+// public key, a nonce and the ChaCha20-Poly1305 ciphertext
+type x25519ChaChaSuite struct{}
+
+func (x25519ChaChaSuite) ID() SuiteID { return SuiteX25519ChaCha20Poly1305 }
+
+func (x25519ChaChaSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+func (s x25519ChaChaSuite) Seal(recipient crypto.PublicKey, plaintext, ad []byte) ([]byte, error) {
+	publicKey, ok := recipient.(*ecdh.PublicKey)
+	if !ok || publicKey.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%s needs an X25519 key, got %T", SuiteX25519ChaCha20Poly1305, recipient)
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := s.deriveAEAD(ephemeral, publicKey, ephemeral.PublicKey(), publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	payload := append(ephemeral.PublicKey().Bytes(), nonce...)
+	return aead.Seal(payload, nonce, plaintext, ad), nil
+}
+
+func (s x25519ChaChaSuite) Open(key crypto.PrivateKey, payload, ad []byte) ([]byte, error) {
+	privateKey, ok := key.(*ecdh.PrivateKey)
+	if !ok || privateKey.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%s needs an X25519 key, got %T", SuiteX25519ChaCha20Poly1305, key)
+	}
+
+	if len(payload) < 32+chacha20poly1305.NonceSize {
+		return nil, errors.New("payload too short")
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(payload[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := s.deriveAEAD(privateKey, ephemeral, ephemeral, privateKey.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := payload[32 : 32+aead.NonceSize()]
+	return aead.Open(nil, nonce, payload[32+aead.NonceSize():], ad)
+}
+
+// Both ends hash the ephemeral and recipient keys into the message key
+func (s x25519ChaChaSuite) deriveAEAD(self *ecdh.PrivateKey, peer, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := self.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	info := append([]byte(SuiteX25519ChaCha20Poly1305), ephemeral.Bytes()...)
+	info = append(info, recipient.Bytes()...)
+	return s.NewAEAD(DeriveKey(shared, nil, info, chacha20poly1305.KeySize))
+}
+
+type ed25519Suite struct{}
+
+func (ed25519Suite) ID() SuiteID { return SuiteEd25519 }
+
+func (ed25519Suite) Sign(key crypto.Signer, message []byte) ([]byte, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s needs an Ed25519 key, got %T", SuiteEd25519, key)
+	}
+	return ed25519.Sign(privateKey, message), nil
+}
+
+func (ed25519Suite) Verify(key crypto.PublicKey, message, signature []byte) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("%s needs an Ed25519 key, got %T", SuiteEd25519, key)
+	}
+	if !ed25519.Verify(publicKey, message, signature) {
+		return errors.New("ed25519: invalid signature")
+	}
+	return nil
+}
+
+// rsaPKCS1Suite wraps SignMessage/VerifySignature
+type rsaPKCS1Suite struct{}
+
+func (rsaPKCS1Suite) ID() SuiteID { return SuiteRSAPKCS1v15SHA256 }
+
+func (rsaPKCS1Suite) Sign(key crypto.Signer, message []byte) ([]byte, error) {
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s needs an RSA key, got %T", SuiteRSAPKCS1v15SHA256, key)
+	}
+	return SignMessage(message, privateKey)
+}
+
+func (rsaPKCS1Suite) Verify(key crypto.PublicKey, message, signature []byte) error {
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%s needs an RSA key, got %T", SuiteRSAPKCS1v15SHA256, key)
+	}
+	return VerifySignature(message, signature, publicKey)
+}
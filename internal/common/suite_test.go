@@ -0,0 +1,156 @@
+package common_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+func TestEnvelopeSuites(t *testing.T) {
+	rsaKey, _, err := common.GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate X25519 key: %v", err)
+	}
+
+	tests := []struct {
+		suite   common.SuiteID
+		public  any
+		private any
+	}{
+		{common.SuiteRSAOAEPAESGCM, &rsaKey.PublicKey, rsaKey},
+		{common.SuiteX25519ChaCha20Poly1305, x25519Key.PublicKey(), x25519Key},
+	}
+
+	message := []byte("sealed in an envelope")
+	ad := []byte("associated data")
+
+	for _, tt := range tests {
+		envelope, err := common.SealEnvelope(tt.suite, tt.public, "kid", message, ad)
+		if err != nil {
+			t.Fatalf("%s: failed to seal: %v", tt.suite, err)
+		}
+		if envelope.Suite != tt.suite || envelope.Version != common.EnvelopeVersion {
+			t.Errorf("%s: envelope has suite %q version %d", tt.suite, envelope.Suite, envelope.Version)
+		}
+
+		opened, err := common.OpenEnvelope(envelope, tt.private, ad)
+		if err != nil {
+			t.Fatalf("%s: failed to open: %v", tt.suite, err)
+		}
+		if string(opened) != string(message) {
+			t.Errorf("%s: opened message doesn't match the original", tt.suite)
+		}
+
+		if _, err := common.OpenEnvelope(envelope, tt.private, []byte("other data")); err == nil {
+			t.Errorf("%s: envelope opened with different associated data", tt.suite)
+		}
+	}
+
+	// A key of the wrong type is refused rather than misused
+	if _, err := common.SealEnvelope(common.SuiteX25519ChaCha20Poly1305, &rsaKey.PublicKey, "", message, ad); err == nil {
+		t.Error("X25519 suite accepted an RSA key")
+	}
+}
+
+func TestMessageSealLegacyCompatible(t *testing.T) {
+	privateKey, publicKey, err := common.GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	msg := common.Message{ID: "1", SenderID: "alice", RecipientID: "bob", Counter: 1}
+	if err := msg.Seal("", publicKey, "", []byte("hello"), "ROOM"); err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	if msg.Envelope != nil {
+		t.Fatal("Legacy suite produced an envelope")
+	}
+
+	// An old client decrypts the original fields directly
+	decrypted, err := common.DecryptMessageWithAD(msg.EncryptedContent, msg.EncryptedKey, privateKey, msg.AssociatedData("ROOM"))
+	if err != nil || string(decrypted) != "hello" {
+		t.Fatalf("Legacy decryption failed: %v", err)
+	}
+
+	opened, err := msg.Open(privateKey, "ROOM")
+	if err != nil || string(opened) != "hello" {
+		t.Fatalf("Failed to open legacy message: %v", err)
+	}
+}
+
+func TestNegotiateCipherSuite(t *testing.T) {
+	suite, err := common.NegotiateCipherSuite(nil)
+	if err != nil || suite.ID() != common.LegacyCipherSuite {
+		t.Errorf("Peer without suites should get the legacy suite, got %v, %v", suite, err)
+	}
+
+	suite, err = common.NegotiateCipherSuite([]common.SuiteID{common.SuiteRSAOAEPAESGCM, common.SuiteX25519ChaCha20Poly1305})
+	if err != nil || suite.ID() != common.SuiteX25519ChaCha20Poly1305 {
+		t.Errorf("Expected the preferred suite, got %v, %v", suite, err)
+	}
+
+	if _, err := common.NegotiateCipherSuite([]common.SuiteID{"rot13"}); err == nil {
+		t.Error("Negotiation succeeded without a common suite")
+	}
+}
+
+func TestEd25519Signatures(t *testing.T) {
+	privateKey, err := common.GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	// Keys survive the PEM round trip used by the config
+	privatePEM, err := common.EncodeSigningKeyToPEM(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to encode private key: %v", err)
+	}
+	publicPEM, err := common.EncodePublicKeyToPEM(privateKey.Public())
+	if err != nil {
+		t.Fatalf("Failed to encode public key: %v", err)
+	}
+	signer, err := common.ParseSigningKeyFromPEM(privatePEM)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+	publicKey, err := common.ParseVerifyingKeyFromPEM(publicPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse public key: %v", err)
+	}
+
+	id, err := common.SignatureSuiteForKey(publicKey)
+	if err != nil || id != common.SuiteEd25519 {
+		t.Fatalf("Expected the Ed25519 suite, got %q, %v", id, err)
+	}
+	suite, err := common.LookupSignatureSuite(id)
+	if err != nil {
+		t.Fatalf("Failed to look up suite: %v", err)
+	}
+
+	message := []byte("signed with ed25519")
+	signature, err := suite.Sign(signer, message)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if err := suite.Verify(publicKey, message, signature); err != nil {
+		t.Errorf("Signature verification failed: %v", err)
+	}
+	if err := suite.Verify(publicKey, []byte("tampered"), signature); err == nil {
+		t.Error("Tampered message verified")
+	}
+
+	// The legacy suite, which an empty ID selects, refuses Ed25519 keys
+	legacy, err := common.LookupSignatureSuite("")
+	if err != nil {
+		t.Fatalf("Failed to look up legacy suite: %v", err)
+	}
+	if err := legacy.Verify(publicKey, message, signature); err == nil {
+		t.Error("RSA suite accepted an Ed25519 key")
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+// MaxRequestSkew is how far a signed account request's timestamp may be from
+// the server's clock. Older requests are refused so they can't be replayed.
+const MaxRequestSkew = 5 * time.Minute
+
+// errStaleRequest is returned for signed requests outside MaxRequestSkew, or
+// older than the key they are signed with
+var errStaleRequest = errors.New("request timestamp is too old or too far ahead")
+
+// HandleKeyRotation replaces a user's key. The request is signed with the old
+// key, and connections authenticated with it are closed.
+func (s *Server) HandleKeyRotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req common.KeyRotationRequest
+	if !decodeAccountRequest(w, r, &req) {
+		return
+	}
+
+	if _, err := common.ParseVerifyingKeyFromPEM(req.PublicKey); err != nil {
+		http.Error(w, "Invalid public key", http.StatusBadRequest)
+		return
+	}
+
+	err := s.store.Update(req.Username, func(user *common.User) error {
+		// A rotation signed before the current key was set would be a replay
+		if !fresh(req.Timestamp) || !req.Timestamp.After(user.KeyUpdated) {
+			return errStaleRequest
+		}
+		if err := verifyUserSignature(*user, common.KeyRotationMessage(req.Username, req.PublicKey, req.Timestamp), req.Signature); err != nil {
+			return err
+		}
+
+		user.PublicKey = req.PublicKey
+		user.KeyUpdated = req.Timestamp
+		return nil
+	})
+	if !s.accountRequestDone(w, req.Username, err) {
+		return
+	}
+
+	log.Printf("Rotated key for %s", req.Username)
+	s.closeConnection(req.Username)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Key rotated successfully"})
+}
+
+// HandleAccountDeletion removes a user, signed with their current key. The
+// username is free to register again afterwards.
+func (s *Server) HandleAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req common.AccountDeletionRequest
+	if !decodeAccountRequest(w, r, &req) {
+		return
+	}
+
+	user, err := s.store.Get(req.Username)
+	if err == nil {
+		// A deletion signed before the key was set, say before the user
+		// registered again with it, would be a replay
+		if !fresh(req.Timestamp) || !req.Timestamp.After(user.KeyUpdated) {
+			err = errStaleRequest
+		} else {
+			err = verifyUserSignature(user, common.AccountDeletionMessage(req.Username, req.Timestamp), req.Signature)
+		}
+	}
+	if err == nil {
+		err = s.store.Delete(req.Username)
+	}
+	if !s.accountRequestDone(w, req.Username, err) {
+		return
+	}
+
+	log.Printf("Deleted account %s", req.Username)
+	s.queue.drop(req.Username)
+	s.closeConnection(req.Username)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account deleted successfully"})
+}
+
+func decodeAccountRequest(w http.ResponseWriter, r *http.Request, req common.Payload) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Answers a failed account request, reporting whether it succeeded instead.
+// Unknown users and bad signatures get the same answer, like failed logins.
+func (s *Server) accountRequestDone(w http.ResponseWriter, username string, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errStaleRequest):
+		http.Error(w, "Request expired, check your clock", http.StatusUnauthorized)
+	case errors.Is(err, ErrUserNotFound) || errors.Is(err, errBadSignature):
+		log.Printf("Refused account request for %s: %v", username, err)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+	default:
+		log.Printf("Failed account request for %s: %v", username, err)
+		http.Error(w, "Failed to update account", http.StatusInternalServerError)
+	}
+	return false
+}
+
+func fresh(timestamp time.Time) bool {
+	skew := time.Since(timestamp)
+	return skew < MaxRequestSkew && skew > -MaxRequestSkew
+}
+
+// Closes the user's packet connection, if they have one
+func (s *Server) closeConnection(username string) {
+	s.onlineLock.RLock()
+	pc, online := s.online[username]
+	s.onlineLock.RUnlock()
+	if online {
+		pc.conn.Close()
+	}
+}
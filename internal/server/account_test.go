@@ -0,0 +1,92 @@
+package server_test
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+func post(t *testing.T, ts *httptest.Server, path string, body interface{}) int {
+	data, _ := json.Marshal(body)
+	resp, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to post to %s: %v", path, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func rotationRequest(t *testing.T, username string, oldKey, newKey crypto.Signer, timestamp time.Time) *common.KeyRotationRequest {
+	publicKey, err := common.EncodePublicKeyToPEM(newKey.Public())
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	signature, err := oldKey.Sign(nil, common.KeyRotationMessage(username, publicKey, timestamp), crypto.Hash(0))
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	return &common.KeyRotationRequest{Username: username, PublicKey: publicKey, Timestamp: timestamp, Signature: signature}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ts := newTestServer(t)
+	oldKey := register(t, ts, "alice")
+	newKey, _ := common.GenerateSigningKey()
+
+	// Only the holder of the old key can rotate
+	if code := post(t, ts, "/users/rotate-key", rotationRequest(t, "alice", newKey, newKey, time.Now())); code != http.StatusUnauthorized {
+		t.Errorf("Rotation signed with the wrong key returned %d", code)
+	}
+	if code := post(t, ts, "/users/rotate-key", rotationRequest(t, "alice", oldKey, newKey, time.Now().Add(-time.Hour))); code != http.StatusUnauthorized {
+		t.Errorf("Stale rotation returned %d", code)
+	}
+
+	request := rotationRequest(t, "alice", oldKey, newKey, time.Now())
+	if code := post(t, ts, "/users/rotate-key", request); code != http.StatusOK {
+		t.Fatalf("Rotation returned %d", code)
+	}
+	if code := post(t, ts, "/users/rotate-key", request); code != http.StatusUnauthorized {
+		t.Errorf("Replayed rotation returned %d", code)
+	}
+
+	conn := dial(t, ts)
+	answerChallenge(t, conn, "alice", oldKey)
+	expectError(t, conn, common.ErrCodeUnauthenticated)
+
+	conn = dial(t, ts)
+	authenticate(t, conn, "alice", newKey)
+}
+
+func TestAccountDeletion(t *testing.T) {
+	ts := newTestServer(t)
+	key := register(t, ts, "alice")
+
+	conn := dial(t, ts)
+	authenticate(t, conn, "alice", key)
+
+	timestamp := time.Now()
+	signature, _ := key.Sign(nil, common.AccountDeletionMessage("alice", timestamp), crypto.Hash(0))
+	request := &common.AccountDeletionRequest{Username: "alice", Timestamp: timestamp, Signature: signature}
+	if code := post(t, ts, "/users/delete", request); code != http.StatusOK {
+		t.Fatalf("Deletion returned %d", code)
+	}
+
+	// The live connection is closed and the username is free again
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("Connection survived account deletion")
+	}
+	registerKey(t, ts, "alice", key)
+
+	// The old request doesn't delete the new account, even with the same key
+	if code := post(t, ts, "/users/delete", request); code != http.StatusUnauthorized {
+		t.Errorf("Replayed deletion returned %d", code)
+	}
+	authenticate(t, dial(t, ts), "alice", key)
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// AuthTimeout is how long a client has to answer the challenge
+	AuthTimeout = 10 * time.Second
+	// MaxAuthFailures failed logins within AuthFailureWindow lock the account and address out
+	MaxAuthFailures   = 5
+	AuthFailureWindow = 15 * time.Minute
+	// AuthLockout is how long a lockout lasts
+	AuthLockout = 15 * time.Minute
+
+	// authSweepInterval is how often records that no longer count are forgotten
+	authSweepInterval = time.Minute
+)
+
+// authFailures counts failed logins per username and per remote address
+type authFailures struct {
+	records map[string]*failureRecord
+	mu      sync.Mutex
+}
+
+type failureRecord struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+func newAuthFailures() *authFailures {
+	return &authFailures{records: make(map[string]*failureRecord)}
+}
+
+// locked reports whether any of the keys is locked out
+func (f *authFailures) locked(keys ...string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if record, ok := f.records[key]; ok && now.Before(record.lockedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// fail records a failed login against every key
+func (f *authFailures) fail(keys ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		record, ok := f.records[key]
+		if !ok || now.Sub(record.first) > AuthFailureWindow {
+			record = &failureRecord{first: now}
+			f.records[key] = record
+		}
+
+		record.count++
+		if record.count >= MaxAuthFailures {
+			record.lockedUntil = now.Add(AuthLockout)
+			record.count = 0
+			record.first = now
+		}
+	}
+}
+
+// succeed forgets earlier failures for the keys
+func (f *authFailures) succeed(keys ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, key := range keys {
+		delete(f.records, key)
+	}
+}
+
+// sweep forgets records whose window has passed and that lock nothing out
+func (f *authFailures) sweep() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	for key, record := range f.records {
+		if now.Sub(record.first) > AuthFailureWindow && !now.Before(record.lockedUntil) {
+			delete(f.records, key)
+		}
+	}
+}
+
+// Forgets failed logins that no longer count, on authSweepInterval until Close
+func (s *Server) sweepAuthFailures() {
+	ticker := time.NewTicker(authSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.authFailures.sweep()
+		}
+	}
+}
+
+// AuthenticateWebSocket sends a random challenge and waits for it to be
+// signed with the key the user registered. The connection is only bound to
+// the username once the signature verifies. Failures are reported to the
+// client as an error packet before the error is returned.
+func (s *Server) AuthenticateWebSocket(conn *websocket.Conn) (string, error) {
+	pc := &packetConn{conn: conn}
+	username, err := s.authenticate(pc)
+	if err != nil {
+		pc.sendError(err)
+		return "", err
+	}
+	return username, nil
+}
+
+func (s *Server) authenticate(pc *packetConn) (string, error) {
+	addressKey := "addr:" + remoteHost(pc.conn)
+	if s.authFailures.locked(addressKey) {
+		s.metrics.authFailures.Add(1)
+		return "", &common.ErrorPayload{Code: common.ErrCodeLocked, Message: "too many failed logins, try again later"}
+	}
+
+	nonce := make([]byte, common.ChallengeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	if err := pc.Send(common.PacketChallenge, &common.ChallengePayload{Nonce: nonce}); err != nil {
+		return "", err
+	}
+
+	pc.conn.SetReadDeadline(time.Now().Add(AuthTimeout))
+	defer pc.conn.SetReadDeadline(time.Time{})
+
+	var packet common.Packet
+	if err := pc.conn.ReadJSON(&packet); err != nil {
+		if isTimeout(err) {
+			return "", &common.ErrorPayload{Code: common.ErrCodeTimeout, Message: "challenge not answered in time"}
+		}
+		return "", &common.ErrorPayload{Code: common.ErrCodeMalformed, Message: "not a packet"}
+	}
+	if packet.Type != common.PacketAuth {
+		return "", &common.ErrorPayload{Code: common.ErrCodeUnauthenticated, Message: "answer the challenge with an auth packet", Packet: packet.Type}
+	}
+
+	var auth common.AuthPayload
+	if err := packet.Decode(&auth); err != nil {
+		return "", err
+	}
+
+	userKey := "user:" + auth.Username
+	if s.authFailures.locked(userKey) {
+		s.metrics.authFailures.Add(1)
+		return "", &common.ErrorPayload{Code: common.ErrCodeLocked, Message: "too many failed logins, try again later"}
+	}
+
+	if err := s.verifyChallenge(auth, nonce); err != nil {
+		// Made up names count against the address only, or anyone could fill
+		// the records with them
+		if errors.Is(err, ErrUserNotFound) {
+			s.authFailures.fail(addressKey)
+		} else {
+			s.authFailures.fail(addressKey, userKey)
+		}
+		s.metrics.authFailures.Add(1)
+		log.Printf("Failed login for %s from %s: %v", auth.Username, remoteHost(pc.conn), err)
+		// The same answer for unknown users and bad signatures, so accounts can't be enumerated
+		return "", &common.ErrorPayload{Code: common.ErrCodeUnauthenticated, Message: "authentication failed", Packet: common.PacketAuth}
+	}
+
+	s.authFailures.succeed(addressKey, userKey)
+	return auth.Username, nil
+}
+
+// Checks the challenge signature against the user's registered key
+func (s *Server) verifyChallenge(auth common.AuthPayload, nonce []byte) error {
+	user, err := s.store.Get(auth.Username)
+	if err != nil {
+		return err
+	}
+	return verifyUserSignature(user, common.AuthChallengeMessage(auth.Username, nonce), auth.Signature)
+}
+
+// errBadSignature is returned when a signature doesn't verify against the
+// user's registered key
+var errBadSignature = errors.New("bad signature")
+
+// Checks a signature against the user's registered key
+func verifyUserSignature(user common.User, message, signature []byte) error {
+	publicKey, err := common.ParseVerifyingKeyFromPEM(user.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	id, err := common.SignatureSuiteForKey(publicKey)
+	if err != nil {
+		return err
+	}
+	suite, err := common.LookupSignatureSuite(id)
+	if err != nil {
+		return err
+	}
+
+	if err := suite.Verify(publicKey, message, signature); err != nil {
+		return fmt.Errorf("%w: %v", errBadSignature, err)
+	}
+	return nil
+}
+
+func remoteHost(conn *websocket.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
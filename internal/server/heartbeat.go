@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultHeartbeatInterval is used when ServerConfig.HeartbeatInterval is 0
+	DefaultHeartbeatInterval = 30 * time.Second
+
+	// pingWriteTimeout bounds writing a single ping
+	pingWriteTimeout = 5 * time.Second
+)
+
+// Returns the ping interval, 0 when heartbeats are off
+func (s *Server) heartbeatInterval() time.Duration {
+	switch {
+	case s.config.HeartbeatInterval == 0:
+		return DefaultHeartbeatInterval
+	case s.config.HeartbeatInterval < 0:
+		return 0
+	}
+	return s.config.HeartbeatInterval
+}
+
+// heartbeat pings conn every interval until the returned stop function is
+// called. Every pong pushes the read deadline back; a peer that misses a pong
+// hits the deadline, so its pending read fails and the caller drops it.
+func (s *Server) heartbeat(conn *websocket.Conn) (stop func()) {
+	interval := s.heartbeatInterval()
+	if interval == 0 {
+		return func() {}
+	}
+
+	// One ping may go unanswered, a second one may not
+	pongWait := 2 * interval
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-s.done:
+				return
+			case <-ticker.C:
+				// WriteControl is safe alongside the connection's other writers
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// Reports whether a read failed by hitting its deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
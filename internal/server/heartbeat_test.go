@@ -0,0 +1,46 @@
+package server_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+func dialRoom(t *testing.T, url, room string) *websocket.Conn {
+	conn, _, err := testDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws?room="+room, nil)
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHeartbeatEvictsSilentPeers(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{
+		HeartbeatInterval: 50 * time.Millisecond,
+		ResumeWindow:      50 * time.Millisecond,
+	})
+
+	room := createRoom(t, ts.URL, 0).Room
+
+	// Never reads, so never answers a ping
+	dialRoom(t, ts.URL, room)
+
+	// Reading answers pings, so this member stays and sees the other one go
+	watcher := dialRoom(t, ts.URL, room)
+	watcher.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := watcher.ReadJSON(&event); err != nil {
+			t.Fatalf("Silent peer wasn't evicted: %v", err)
+		}
+		if event.Type == "member_left" {
+			return
+		}
+	}
+}
@@ -12,123 +12,164 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-var (
-	rooms   = make(map[string]*Room) // In-memory room storage
-	roomsMu sync.RWMutex             // Protects concurrent access to rooms
-)
-
-type Room struct {
-	Clients map[*websocket.Conn]bool
-	mu      sync.Mutex
+type Server struct {
+	config       common.ServerConfig
+	clients      map[*websocket.Conn]bool
+	rooms        map[string]*Room
+	roomsMu      sync.Mutex
+	clientsLock  sync.RWMutex
+	store        UserStore
+	online       map[string]*packetConn       // authenticated packet connections by username
+	presence     map[string]common.UserStatus // of users not offline, never stored so a restart can't leave anyone online
+	onlineLock   sync.RWMutex                 // protects online and presence
+	router       *Router
+	relayStats   relayStats
+	metrics      metrics
+	limits       ipLimits
+	authFailures *authFailures
+	queue        *messageQueue
+	done         chan struct{} // closed by Close to stop background work
 }
 
-// Convert http connection into websocket connection
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// NewServer creates a server that keeps its users in memory
+func NewServer(config common.ServerConfig) *Server {
+	return NewServerWithStore(config, NewMemoryUserStore())
 }
 
-type Server struct {
-	config      common.ServerConfig
-	clients     map[*websocket.Conn]bool
-	clientsLock sync.RWMutex
-	users       map[string]common.User
-	usersLock   sync.RWMutex
+// NewServerWithStore creates a server that keeps its users in store
+func NewServerWithStore(config common.ServerConfig, store UserStore) *Server {
+	s := &Server{
+		config:   config,
+		clients:  make(map[*websocket.Conn]bool),
+		rooms:    make(map[string]*Room),
+		store:    store,
+		online:   make(map[string]*packetConn),
+		presence: make(map[string]common.UserStatus),
+		router:   NewRouter(),
+
+		authFailures: newAuthFailures(),
+		queue:        newMessageQueue(config),
+		done:         make(chan struct{}),
+	}
+	s.limits.hosts = make(map[string]*hostLimits)
+	s.registerHandlers()
+	if s.queue.ttl > 0 {
+		go s.sweepQueue()
+	}
+	go s.sweepLimits()
+	go s.sweepAuthFailures()
+	return s
 }
 
-func NewServer(config common.ServerConfig) *Server {
-	return &Server{
-		config:  config,
-		clients: make(map[*websocket.Conn]bool),
-		users:   make(map[string]common.User),
-	}
+// Close stops the server's background work. The user store is left open,
+// it belongs to the caller.
+func (s *Server) Close() {
+	close(s.done)
 }
 
+// HandleWebSocket serves two kinds of connection: with a room code it joins
+// the room, or resumes a slot in it given a resume token, and relays frames
+// between members; without one it speaks common.Packet to registered users.
+// Either way the connection is held to the frame size and rate limits.
 func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	roomCode := r.URL.Query().Get("room") // retrieve roomcode from url query string
-	if roomCode == "" {
-		http.Error(w, "Room code required", http.StatusBadRequest)
+
+	if !s.checkUpgrade(w, r) {
 		return
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		s.metrics.upgradeErrors.Add(1)
 		log.Printf("WebSocket upgrade failed: %v", err)
 		return
 	}
+	s.limitFrameSize(conn)
 
-	// Get or Create Room
-	roomsMu.Lock()
-	room, exists := rooms[roomCode] // check if the room exists
-	// if not create the room
-	if !exists {
-		room = &Room{Clients: make(map[*websocket.Conn]bool)}
-		rooms[roomCode] = room
+	host := remoteHost(conn)
+	release, ok := s.acquireConnection(host)
+	if !ok {
+		s.metrics.connectionLimited.Add(1)
+		closeForLimit(conn, "too many connections")
+		return
 	}
-	roomsMu.Unlock()
+	defer release()
 
-	// Add client to room
-	room.mu.Lock()
-	room.Clients[conn] = true
-	room.mu.Unlock()
-
-	log.Printf("Client joined room %s", roomCode)
-
-	// Message relay loop
-	for {
-		_, msg, err := conn.ReadMessage()
-		if err != nil {
-			break
-		}
-
-		// Broadcast to all other clients in the room
-		room.mu.Lock()
-		for client := range room.Clients {
-			if client != conn {
-				if err := client.WriteMessage(websocket.TextMessage, msg); err != nil {
-					log.Printf("Failed to relay message: %v", err)
-					delete(room.Clients, client)
-				}
-			}
-		}
-		room.mu.Unlock()
+	if roomCode == "" {
+		s.metrics.packetConnections.Add(1)
+		defer s.metrics.packetConnections.Add(-1)
+		s.handleMessages(conn)
+		return
 	}
 
-	room.mu.Lock()
-	delete(room.Clients, conn)
-	// if the room is empty close the websocket connection
-	if len(room.Clients) == 0 {
-		roomsMu.Lock()
-		delete(rooms, roomCode)
-		roomsMu.Unlock()
+	if !s.allowJoin(host) {
+		s.metrics.joinLimited.Add(1)
+		closeForLimit(conn, "joining rooms too fast")
+		return
 	}
-	room.mu.Unlock()
-	conn.Close()
+
+	s.metrics.roomConnections.Add(1)
+	defer s.metrics.roomConnections.Add(-1)
+	s.handleRoom(conn, roomCode, r.URL.Query().Get("resume"), r.URL.Query().Get("owner"))
 }
 
+// Authenticates the connection, then reads packets until it closes,
+// answering refused ones with an error packet
 func (s *Server) handleMessages(conn *websocket.Conn) {
+	username, err := s.AuthenticateWebSocket(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	pc := &packetConn{conn: conn}
+
+	s.clientsLock.Lock()
+	s.clients[conn] = true
+	s.clientsLock.Unlock()
+
 	defer func() {
+		s.disconnect(pc)
 		s.clientsLock.Lock()
 		delete(s.clients, conn)
 		s.clientsLock.Unlock()
 		conn.Close()
 	}()
 
+	if err := s.connect(pc, username); err != nil {
+		log.Printf("Failed to confirm login: %v", err)
+		return
+	}
+
+	stopHeartbeat := s.heartbeat(conn)
+	defer stopHeartbeat()
+
+	limiter := s.newFrameLimiter(remoteHost(conn))
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading message: %v", err)
+			switch {
+			case isTimeout(err):
+				log.Printf("Dropping unresponsive client %s", username)
+			case errors.Is(err, websocket.ErrReadLimit):
+				s.metrics.frameTooLarge.Add(1)
+				log.Printf("Dropping client %s for an oversized frame", username)
+			default:
+				log.Printf("Error reading message: %v", err)
+			}
 			break
 		}
 
-		var packet common.Packet
-		if err := json.Unmarshal(message, &packet); err != nil {
-			log.Printf("Error unmarshaling packet: %v", err)
-			continue
+		if !limiter.allow() {
+			s.metrics.frameLimited.Add(1)
+			log.Printf("Dropping client %s for sending too fast", username)
+			closeForLimit(conn, "sending too fast")
+			break
 		}
 
-		log.Printf("Received packet: %+v", packet)
+		if err := s.router.Dispatch(pc, message); err != nil {
+			pc.sendError(err)
+		}
 	}
 }
 
@@ -140,66 +181,54 @@ func (s *Server) HandleRegistration(w http.ResponseWriter, r *http.Request) {
 
 	// Decode the request body
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.metrics.registrationInvalid.Add(1)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Validate the username
-	if req.Username == "" {
-		http.Error(w, "Username is required", http.StatusBadRequest)
+	// Validate the username, a name packets refuse could never log in
+	if err := common.ValidateUsername(req.Username); err != nil {
+		s.metrics.registrationInvalid.Add(1)
+		http.Error(w, "Invalid username", http.StatusBadRequest)
 		return
 	}
 
-	// Check if the username is already taken
-	s.usersLock.Lock()
-	defer s.usersLock.Unlock()
-	if _, exists := s.users[req.Username]; exists {
-		http.Error(w, "Username already taken", http.StatusConflict)
+	// The key answers login challenges, so it must be one we can verify with
+	if _, err := common.ParseVerifyingKeyFromPEM(req.PublicKey); err != nil {
+		s.metrics.registrationInvalid.Add(1)
+		http.Error(w, "Invalid public key", http.StatusBadRequest)
 		return
 	}
 
 	// Create a new user
+	now := time.Now()
 	user := common.User{
-		Username:  req.Username,
-		PublicKey: req.PublicKey,
-		Status:    common.StatusOffline,
-		LastSeen:  time.Now(),
+		Username:   req.Username,
+		PublicKey:  req.PublicKey,
+		Status:     common.StatusOffline,
+		LastSeen:   now,
+		KeyUpdated: now,
+	}
+
+	// Store the user, unless the username is already taken
+	if err := s.store.Create(user); err != nil {
+		if errors.Is(err, ErrUserExists) {
+			s.metrics.registrationTaken.Add(1)
+			http.Error(w, "Username already taken", http.StatusConflict)
+			return
+		}
+		s.metrics.registrationErrors.Add(1)
+		log.Printf("Failed to store user: %v", err)
+		http.Error(w, "Failed to register user", http.StatusInternalServerError)
+		return
 	}
 
-	// Store the user
-	s.users[req.Username] = user
-
 	// Respond with success
+	s.metrics.registered.Add(1)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully"})
 }
 
-// AuthenticateWebSocket authenticates WebSocket connections
-func (s *Server) AuthenticateWebSocket(conn *websocket.Conn) (string, error) {
-	// Read the first message (authentication token)
-	_, message, err := conn.ReadMessage()
-	if err != nil {
-		return "", err
-	}
-
-	var auth struct {
-		Username string `json:"username"`
-		Token    string `json:"token"`
-	}
-	if err := json.Unmarshal(message, &auth); err != nil {
-		return "", err
-	}
-
-	// Validate the token (for now, just check if the user exists)
-	s.usersLock.RLock()
-	defer s.usersLock.RUnlock()
-	if _, exists := s.users[auth.Username]; !exists {
-		return "", errors.New("user not found")
-	}
-
-	return auth.Username, nil
-}
-
 func (s *Server) HandleStatusCheck(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Server is running"))
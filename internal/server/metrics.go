@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+)
+
+// metrics counts what the server does, for /metrics. Nothing is labelled
+// with a room code or username, the endpoint must not leak who talks to whom.
+type metrics struct {
+	roomConnections   atomic.Int64
+	packetConnections atomic.Int64
+	upgradeErrors     atomic.Uint64
+	badOrigin         atomic.Uint64
+	badSubprotocol    atomic.Uint64
+	authFailures      atomic.Uint64
+
+	// Connections closed for tripping a limit, by limit
+	frameTooLarge     atomic.Uint64
+	frameLimited      atomic.Uint64
+	joinLimited       atomic.Uint64
+	connectionLimited atomic.Uint64
+
+	// Registration attempts by outcome
+	registered          atomic.Uint64
+	registrationInvalid atomic.Uint64
+	registrationTaken   atomic.Uint64
+	registrationErrors  atomic.Uint64
+}
+
+// HandleMetrics serves the server's counters in the Prometheus text format
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	active, waiting := s.countRooms()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetric(w, "xtty_rooms_active", "gauge", "Rooms with at least one member.",
+		sample{value: float64(active)})
+	writeMetric(w, "xtty_rooms_waiting", "gauge", "Rooms nobody is in, waiting for members.",
+		sample{value: float64(waiting)})
+	writeMetric(w, "xtty_connections_active", "gauge", "Open WebSocket connections.",
+		sample{`kind="room"`, float64(s.metrics.roomConnections.Load())},
+		sample{`kind="packet"`, float64(s.metrics.packetConnections.Load())})
+	writeMetric(w, "xtty_relayed_frames_total", "counter", "Frames queued for room members.",
+		sample{value: float64(s.relayStats.relayed.Load())})
+	writeMetric(w, "xtty_relayed_bytes_total", "counter", "Bytes queued for room members.",
+		sample{value: float64(s.relayStats.bytes.Load())})
+	writeMetric(w, "xtty_relay_write_failures_total", "counter", "Frames that could not be written to a room member.",
+		sample{value: float64(s.relayStats.writeFailures.Load())})
+	writeMetric(w, "xtty_relay_dropped_frames_total", "counter", "Frames dropped because a member's queue was full.",
+		sample{value: float64(s.relayStats.dropped.Load())})
+	writeMetric(w, "xtty_relay_slow_disconnects_total", "counter", "Members disconnected for not reading fast enough.",
+		sample{value: float64(s.relayStats.slowDisconnects.Load())})
+	writeMetric(w, "xtty_registration_attempts_total", "counter", "Registration requests by result.",
+		sample{`result="created"`, float64(s.metrics.registered.Load())},
+		sample{`result="invalid"`, float64(s.metrics.registrationInvalid.Load())},
+		sample{`result="taken"`, float64(s.metrics.registrationTaken.Load())},
+		sample{`result="error"`, float64(s.metrics.registrationErrors.Load())})
+	writeMetric(w, "xtty_auth_failures_total", "counter", "Logins refused for a bad answer or a lockout.",
+		sample{value: float64(s.metrics.authFailures.Load())})
+	writeMetric(w, "xtty_limit_trips_total", "counter", "Connections closed for going over a limit, by limit.",
+		sample{`limit="frame_size"`, float64(s.metrics.frameTooLarge.Load())},
+		sample{`limit="frame_rate"`, float64(s.metrics.frameLimited.Load())},
+		sample{`limit="join_rate"`, float64(s.metrics.joinLimited.Load())},
+		sample{`limit="connections"`, float64(s.metrics.connectionLimited.Load())})
+	writeMetric(w, "xtty_upgrade_errors_total", "counter", "Requests to /ws that failed the WebSocket upgrade.",
+		sample{value: float64(s.metrics.upgradeErrors.Load())})
+	writeMetric(w, "xtty_upgrade_rejections_total", "counter", "WebSocket requests turned away before the upgrade, by reason.",
+		sample{`reason="origin"`, float64(s.metrics.badOrigin.Load())},
+		sample{`reason="subprotocol"`, float64(s.metrics.badSubprotocol.Load())})
+}
+
+// Counts the rooms with members in them and the rooms without
+func (s *Server) countRooms() (active, waiting int) {
+	// Rooms are locked before s.roomsMu elsewhere, so not while holding it
+	s.roomsMu.Lock()
+	rooms := slices.Collect(maps.Values(s.rooms))
+	s.roomsMu.Unlock()
+
+	for _, room := range rooms {
+		room.mu.Lock()
+		switch {
+		case room.closed:
+		case len(room.Members) > 0:
+			active++
+		default:
+			waiting++
+		}
+		room.mu.Unlock()
+	}
+	return active, waiting
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+func writeMetric(w io.Writer, name, kind, help string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		// Counters get big, %g would switch to exponents
+		value := strconv.FormatFloat(s.value, 'f', -1, 64)
+		if s.labels == "" {
+			fmt.Fprintf(w, "%s %s\n", name, value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, s.labels, value)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func scrape(t *testing.T, url string) string {
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t)
+	register(t, ts, "alice")
+
+	room := createRoom(t, ts.URL, 0).Room
+	alice := dialRoom(t, ts.URL, room)
+	readEvent(t, alice)
+	bob := dialRoom(t, ts.URL, room)
+	readEvent(t, bob)
+	readEvent(t, alice)      // bob joined
+	createRoom(t, ts.URL, 0) // nobody joins this one
+
+	if err := alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"message","text":"hi"}`)); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	readEvent(t, bob)
+
+	metrics := scrape(t, ts.URL)
+	for _, line := range []string{
+		"xtty_rooms_active 1",
+		"xtty_rooms_waiting 1",
+		`xtty_connections_active{kind="room"} 2`,
+		`xtty_registration_attempts_total{result="created"} 1`,
+		"xtty_upgrade_errors_total 0",
+		"# TYPE xtty_relayed_bytes_total counter",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, room) {
+		t.Error("Metrics leak the room code")
+	}
+}
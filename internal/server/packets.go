@@ -0,0 +1,193 @@
+package server
+
+import (
+	"errors"
+	"log"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+// Registers the handler for every packet type the server understands. New
+// packet types only need a payload type in common and a line here.
+func (s *Server) registerHandlers() {
+	Handle(s.router, common.PacketError, s.handleErrorPacket)
+	Handle(s.router, common.PacketMessage, s.handleMessagePacket)
+	Handle(s.router, common.PacketFriendRequest, s.handleFriendRequest)
+	Handle(s.router, common.PacketStatus, s.handleStatus)
+	Handle(s.router, common.PacketReadReceipt, s.handleReadReceipt)
+	Handle(s.router, common.PacketTyping, s.handleTyping)
+	Handle(s.router, common.PacketAck, s.handleAck)
+}
+
+// Binds an authenticated connection to its user, marks them online and tells
+// them which of their friends are around
+func (s *Server) connect(pc *packetConn, username string) error {
+	pc.mu.Lock()
+	pc.username = username
+	pc.mu.Unlock()
+
+	// A newer connection takes over from an older one
+	s.onlineLock.Lock()
+	s.online[username] = pc
+	s.presence[username] = common.StatusOnline
+	s.onlineLock.Unlock()
+
+	if err := pc.Send(common.PacketAuthOK, &common.AuthOKPayload{Username: username}); err != nil {
+		return err
+	}
+
+	// Friends missing from presence are offline, which clients assume anyway
+	user, err := s.store.Get(username)
+	if err != nil {
+		return err
+	}
+	for _, friend := range user.FriendList {
+		s.onlineLock.RLock()
+		status, ok := s.presence[friend]
+		s.onlineLock.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := pc.Send(common.PacketStatus, &common.StatusPayload{Username: friend, Status: status}); err != nil {
+			return err
+		}
+	}
+
+	// Messages that arrived while they were away, held until acknowledged
+	for _, message := range s.queue.pending(username) {
+		if err := pc.Send(common.PacketMessage, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clients report errors in packets we sent them, there is nothing to answer
+func (s *Server) handleErrorPacket(pc *packetConn, payload *common.ErrorPayload) error {
+	log.Printf("Client reported error: %v", payload)
+	return nil
+}
+
+func (s *Server) handleMessagePacket(pc *packetConn, message *common.Message) error {
+	if err := s.checkSender(pc, message.SenderID); err != nil {
+		return err
+	}
+
+	err := s.deliver(message.RecipientID, common.PacketMessage, message)
+	if err == nil {
+		return nil
+	}
+	var refused *common.ErrorPayload
+	if errors.As(err, &refused) && refused.Code == common.ErrCodeNotFound {
+		return err
+	}
+
+	// Offline, or their connection just failed, hold it for their next login
+	return s.queue.push(message)
+}
+
+func (s *Server) handleFriendRequest(pc *packetConn, request *common.FriendRequests) error {
+	if err := s.checkSender(pc, request.FromUser); err != nil {
+		return err
+	}
+	return s.deliver(request.ToUser, common.PacketFriendRequest, request)
+}
+
+// Records the user's status and tells their friends who are online
+func (s *Server) handleStatus(pc *packetConn, status *common.StatusPayload) error {
+	if err := s.checkSender(pc, status.Username); err != nil {
+		return err
+	}
+
+	user, err := s.store.Get(status.Username)
+	if err != nil {
+		return err
+	}
+
+	s.onlineLock.Lock()
+	if status.Status == common.StatusOffline {
+		delete(s.presence, status.Username)
+	} else {
+		s.presence[status.Username] = status.Status
+	}
+	s.onlineLock.Unlock()
+
+	// Friends being offline is expected, they see the status on their next login
+	for _, friend := range user.FriendList {
+		s.deliver(friend, common.PacketStatus, status)
+	}
+	return nil
+}
+
+func (s *Server) handleReadReceipt(pc *packetConn, receipt *common.ReadReceiptPayload) error {
+	if err := s.checkSender(pc, receipt.From); err != nil {
+		return err
+	}
+	return s.deliver(receipt.To, common.PacketReadReceipt, receipt)
+}
+
+func (s *Server) handleTyping(pc *packetConn, typing *common.TypingPayload) error {
+	if err := s.checkSender(pc, typing.From); err != nil {
+		return err
+	}
+	return s.deliver(typing.To, common.PacketTyping, typing)
+}
+
+// The recipient has a held message, stop holding it
+func (s *Server) handleAck(pc *packetConn, ack *common.AckPayload) error {
+	s.queue.ack(pc.user(), ack.From, ack.MessageID)
+	return nil
+}
+
+// Packets may only be sent in the name of the authenticated user
+func (s *Server) checkSender(pc *packetConn, claimed string) error {
+	if claimed != pc.user() {
+		return &common.ErrorPayload{Code: common.ErrCodeForbidden, Message: "sender doesn't match the authenticated user"}
+	}
+	return nil
+}
+
+// Sends a packet to a registered user's live connection
+func (s *Server) deliver(username, packetType string, data common.Payload) error {
+	if _, err := s.store.Get(username); err != nil {
+		return &common.ErrorPayload{Code: common.ErrCodeNotFound, Message: "no such user"}
+	}
+
+	s.onlineLock.RLock()
+	recipient, online := s.online[username]
+	s.onlineLock.RUnlock()
+	if !online {
+		return &common.ErrorPayload{Code: common.ErrCodeOffline, Message: "recipient is offline"}
+	}
+
+	return recipient.Send(packetType, data)
+}
+
+// Marks the connection's user offline, unless they have already reconnected
+func (s *Server) disconnect(pc *packetConn) {
+	username := pc.user()
+	if username == "" {
+		return
+	}
+
+	s.onlineLock.Lock()
+	if s.online[username] != pc {
+		s.onlineLock.Unlock()
+		return
+	}
+	delete(s.online, username)
+	delete(s.presence, username)
+	s.onlineLock.Unlock()
+
+	// The account may have been deleted while connected, then there is no one to tell
+	user, err := s.store.Get(username)
+	if err != nil {
+		return
+	}
+
+	// Friends learn about the departure like any other status change
+	status := &common.StatusPayload{Username: username, Status: common.StatusOffline}
+	for _, friend := range user.FriendList {
+		s.deliver(friend, common.PacketStatus, status)
+	}
+}
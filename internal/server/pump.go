@@ -0,0 +1,158 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultSendQueueSize is used when ServerConfig.SendQueueSize is 0
+	DefaultSendQueueSize = 256
+
+	// writeTimeout bounds writing a single frame, a peer that can't take one
+	// in this long is treated as gone
+	writeTimeout = 10 * time.Second
+)
+
+// relayStats counts what happened to frames relayed between room members
+type relayStats struct {
+	relayed         atomic.Uint64 // frames queued for a member
+	bytes           atomic.Uint64 // bytes in those frames
+	writeFailures   atomic.Uint64 // frames that failed to write, the member is dropped
+	dropped         atomic.Uint64 // frames dropped from a full queue
+	slowDisconnects atomic.Uint64 // members disconnected for a full queue
+}
+
+// writePump owns every data write to a room member's connection. Frames are
+// queued without blocking, so one slow reader can't hold up the room, and a
+// single goroutine writes them out so gorilla never sees concurrent writers.
+type writePump struct {
+	conn      *websocket.Conn
+	queue     chan outgoing
+	policy    string
+	stats     *relayStats
+	done      chan struct{}
+	closeOnce sync.Once
+	goodbye   []byte // close frame for run to send once done is closed
+}
+
+func (s *Server) newWritePump(conn *websocket.Conn) *writePump {
+	size := s.config.SendQueueSize
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+	policy := s.config.SendQueuePolicy
+	if policy == "" {
+		policy = common.QueuePolicyDisconnect
+	}
+
+	p := &writePump{
+		conn:   conn,
+		queue:  make(chan outgoing, size),
+		policy: policy,
+		stats:  &s.relayStats,
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// outgoing is a frame queued for a member. The relay's own events go out as
+// text messages and frames from other members as binary ones, so clients can
+// tell which of them the relay vouches for.
+type outgoing struct {
+	messageType int
+	data        []byte
+}
+
+func fromRelay(msg []byte) outgoing {
+	return outgoing{messageType: websocket.TextMessage, data: msg}
+}
+
+func fromMember(msg []byte) outgoing {
+	return outgoing{messageType: websocket.BinaryMessage, data: msg}
+}
+
+// send queues a frame. When the queue is full the pump's policy decides
+// whether the oldest queued frame makes room or the member is disconnected.
+func (p *writePump) send(msg outgoing) {
+	for {
+		select {
+		case <-p.done:
+			return
+		case p.queue <- msg:
+			p.stats.relayed.Add(1)
+			p.stats.bytes.Add(uint64(len(msg.data)))
+			return
+		default:
+		}
+
+		if p.policy != common.QueuePolicyDropOldest {
+			p.stats.slowDisconnects.Add(1)
+			p.closeLater(websocket.ClosePolicyViolation, "not reading fast enough")
+			return
+		}
+
+		select {
+		case <-p.queue:
+			p.stats.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+func (p *writePump) run() {
+	for {
+		select {
+		case <-p.done:
+			if p.goodbye != nil {
+				p.conn.WriteControl(websocket.CloseMessage, p.goodbye, time.Now().Add(time.Second))
+				p.conn.Close()
+			}
+			return
+		case msg := <-p.queue:
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := p.conn.WriteMessage(msg.messageType, msg.data); err != nil {
+				select {
+				case <-p.done:
+					// Closed on purpose while the write was blocked
+				default:
+					p.stats.writeFailures.Add(1)
+					log.Printf("Failed to relay message: %v", err)
+				}
+				// The reader notices the closed connection and leaves the room
+				p.stop()
+				p.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// close tells the member why it is being dropped, if the close frame can
+// still get through, and closes the connection
+func (p *writePump) close(code int, reason string) {
+	p.stop()
+	p.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	p.conn.Close()
+}
+
+// closeLater is close for callers holding room.mu. The pump stops at once
+// and run sends the close frame after the frame it is writing, so nothing
+// waits on a stalled write. A pump already stopped has closed its connection.
+func (p *writePump) closeLater(code int, reason string) {
+	p.closeOnce.Do(func() {
+		p.goodbye = websocket.FormatCloseMessage(code, reason)
+		close(p.done)
+	})
+}
+
+// stop ends the pump, frames still queued are discarded
+func (p *writePump) stop() {
+	p.closeOnce.Do(func() { close(p.done) })
+}
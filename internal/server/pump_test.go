@@ -0,0 +1,54 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+func TestSlowRoomMemberIsDisconnected(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{
+		SendQueueSize:   4,
+		SendQueuePolicy: common.QueuePolicyDisconnect,
+		FrameRate:       -1, // flooding the room is the point here
+		IPFrameRate:     -1,
+	})
+
+	room := createRoom(t, ts.URL, 0).Room
+	slow := dialRoom(t, ts.URL, room)
+	fast := dialRoom(t, ts.URL, room)
+
+	// Keep the fast member reading so only the slow one falls behind
+	go func() {
+		for {
+			if _, _, err := fast.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Far more than the socket buffers and the queue hold together
+	frame := bytes.Repeat([]byte("x"), 256<<10)
+	for i := 0; i < 256; i++ {
+		fast.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if err := fast.WriteMessage(websocket.TextMessage, frame); err != nil {
+			t.Fatalf("The fast member was held up by the slow one: %v", err)
+		}
+	}
+
+	slow.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, err := slow.ReadMessage(); err != nil {
+			// The close frame can be stuck behind a stalled write, then the connection just ends
+			if websocket.IsCloseError(err, websocket.ClosePolicyViolation) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return
+			}
+			t.Fatalf("Expected the slow member to be disconnected, got %v", err)
+		}
+	}
+}
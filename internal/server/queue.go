@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+const (
+	// DefaultMessageTTL is used when ServerConfig.MessageTTL is 0
+	DefaultMessageTTL = 7 * 24 * time.Hour
+	// DefaultMaxQueuedMessages and DefaultMaxQueuedBytes cap what is held for one recipient
+	DefaultMaxQueuedMessages = 500
+	DefaultMaxQueuedBytes    = 16 << 20
+	// DefaultMaxQueuedMessagesPerSender and DefaultMaxQueuedBytesPerSender cap
+	// what one sender may hold of that, so nobody can fill a recipient's queue
+	DefaultMaxQueuedMessagesPerSender = 100
+	DefaultMaxQueuedBytesPerSender    = 4 << 20
+
+	// sweepInterval is how often expired messages are dropped
+	sweepInterval = time.Minute
+)
+
+type queuedMessage struct {
+	message *common.Message
+	size    int
+	expires time.Time
+}
+
+// messageQueue holds messages for offline recipients until they are
+// acknowledged or expire. The server can't read them, only ciphertext is held.
+type messageQueue struct {
+	ttl               time.Duration
+	maxMessages       int
+	maxBytes          int
+	maxSenderMessages int                        // maxMessages for one sender's messages to a recipient
+	maxSenderBytes    int                        // likewise maxBytes
+	queues            map[string][]queuedMessage // by recipient
+	bytes             map[string]int
+	mu                sync.Mutex
+}
+
+func newMessageQueue(config common.ServerConfig) *messageQueue {
+	q := &messageQueue{
+		ttl:         config.MessageTTL,
+		maxMessages: config.MaxQueuedMessages,
+		maxBytes:    config.MaxQueuedBytes,
+
+		maxSenderMessages: config.MaxQueuedMessagesPerSender,
+		maxSenderBytes:    config.MaxQueuedBytesPerSender,
+
+		queues: make(map[string][]queuedMessage),
+		bytes:  make(map[string]int),
+	}
+	if q.ttl == 0 {
+		q.ttl = DefaultMessageTTL
+	}
+	if q.maxMessages <= 0 {
+		q.maxMessages = DefaultMaxQueuedMessages
+	}
+	if q.maxBytes <= 0 {
+		q.maxBytes = DefaultMaxQueuedBytes
+	}
+	if q.maxSenderMessages <= 0 {
+		q.maxSenderMessages = DefaultMaxQueuedMessagesPerSender
+	}
+	if q.maxSenderBytes <= 0 {
+		q.maxSenderBytes = DefaultMaxQueuedBytesPerSender
+	}
+	return q
+}
+
+// push holds a message for its recipient. Resending a held message replaces
+// it rather than holding it twice.
+func (q *messageQueue) push(message *common.Message) error {
+	if q.ttl < 0 {
+		return &common.ErrorPayload{Code: common.ErrCodeOffline, Message: "recipient is offline"}
+	}
+	if message.EncryptedContent == nil && message.Envelope == nil {
+		return &common.ErrorPayload{Code: common.ErrCodeOffline, Message: "recipient is offline, only encrypted messages are held"}
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	recipient := message.RecipientID
+	q.remove(recipient, message.SenderID, message.ID)
+	if len(q.queues[recipient]) >= q.maxMessages || q.bytes[recipient]+len(data) > q.maxBytes {
+		return &common.ErrorPayload{Code: common.ErrCodeQuotaExceeded, Message: "recipient has too many messages waiting"}
+	}
+
+	messages, bytes := 0, 0
+	for _, queued := range q.queues[recipient] {
+		if queued.message.SenderID == message.SenderID {
+			messages++
+			bytes += queued.size
+		}
+	}
+	if messages >= q.maxSenderMessages || bytes+len(data) > q.maxSenderBytes {
+		return &common.ErrorPayload{Code: common.ErrCodeQuotaExceeded, Message: "too many of your messages are waiting for this recipient"}
+	}
+
+	q.queues[recipient] = append(q.queues[recipient], queuedMessage{
+		message: message,
+		size:    len(data),
+		expires: time.Now().Add(q.ttl),
+	})
+	q.bytes[recipient] += len(data)
+	return nil
+}
+
+// pending returns the messages held for a recipient, oldest first. They stay
+// held until acknowledged.
+func (q *messageQueue) pending(recipient string) []*common.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var messages []*common.Message
+	for _, queued := range q.queues[recipient] {
+		if now.Before(queued.expires) {
+			messages = append(messages, queued.message)
+		}
+	}
+	return messages
+}
+
+// ack stops holding a message once its recipient has it
+func (q *messageQueue) ack(recipient, sender, messageID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.remove(recipient, sender, messageID)
+}
+
+// Removes one held message, q.mu must be held
+func (q *messageQueue) remove(recipient, sender, messageID string) {
+	queue := q.queues[recipient]
+	for i, queued := range queue {
+		if queued.message.SenderID == sender && queued.message.ID == messageID {
+			q.bytes[recipient] -= queued.size
+			q.queues[recipient] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	q.forgetIfEmpty(recipient)
+}
+
+// drop forgets everything held for a recipient
+func (q *messageQueue) drop(recipient string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.queues, recipient)
+	delete(q.bytes, recipient)
+}
+
+// sweep drops expired messages and returns how many there were
+func (q *messageQueue) sweep(now time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	expired := 0
+	for recipient, queue := range q.queues {
+		kept := queue[:0]
+		for _, queued := range queue {
+			if now.Before(queued.expires) {
+				kept = append(kept, queued)
+			} else {
+				q.bytes[recipient] -= queued.size
+				expired++
+			}
+		}
+		q.queues[recipient] = kept
+		q.forgetIfEmpty(recipient)
+	}
+	return expired
+}
+
+// q.mu must be held
+func (q *messageQueue) forgetIfEmpty(recipient string) {
+	if len(q.queues[recipient]) == 0 {
+		delete(q.queues, recipient)
+		delete(q.bytes, recipient)
+	}
+}
+
+// Drops expired messages until the server is closed
+func (s *Server) sweepQueue() {
+	ticker := time.NewTicker(min(sweepInterval, max(s.queue.ttl, time.Second)))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			if expired := s.queue.sweep(now); expired > 0 {
+				log.Printf("Dropped %d expired messages", expired)
+			}
+		}
+	}
+}
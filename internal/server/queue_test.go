@@ -0,0 +1,106 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+func encryptedMessage(id string) *common.Message {
+	return &common.Message{ID: id, SenderID: "alice", RecipientID: "bob", EncryptedContent: []byte("ciphertext " + id)}
+}
+
+func expectMessage(t *testing.T, conn *websocket.Conn, id string) {
+	t.Helper()
+
+	var message common.Message
+	packet := receive(t, conn)
+	if packet.Type != common.PacketMessage || packet.Decode(&message) != nil {
+		t.Fatalf("Expected message %s, got %q %s", id, packet.Type, packet.Data)
+	}
+	if message.ID != id {
+		t.Fatalf("Expected message %s, got %s", id, message.ID)
+	}
+}
+
+func TestOfflineMessagesHeldUntilAcked(t *testing.T) {
+	ts := newTestServer(t)
+	aliceKey := register(t, ts, "alice")
+	bobKey := register(t, ts, "bob")
+
+	alice := dial(t, ts)
+	authenticate(t, alice, "alice", aliceKey)
+	send(t, alice, common.PacketMessage, encryptedMessage("1"))
+	send(t, alice, common.PacketMessage, encryptedMessage("2"))
+
+	// Plaintext isn't held
+	send(t, alice, common.PacketMessage, &common.Message{ID: "3", SenderID: "alice", RecipientID: "bob", Content: "hi"})
+	expectError(t, alice, common.ErrCodeOffline)
+
+	bob := dial(t, ts)
+	authenticate(t, bob, "bob", bobKey)
+	expectMessage(t, bob, "1")
+	expectMessage(t, bob, "2")
+	send(t, bob, common.PacketAck, &common.AckPayload{MessageID: "1", From: "alice"})
+	bob.Close()
+
+	// Only the unacknowledged message comes back on the next login
+	bob = dial(t, ts)
+	authenticate(t, bob, "bob", bobKey)
+	expectMessage(t, bob, "2")
+}
+
+func TestOfflineQueueQuota(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{MaxQueuedMessages: 2})
+	aliceKey := register(t, ts, "alice")
+	register(t, ts, "bob")
+
+	alice := dial(t, ts)
+	authenticate(t, alice, "alice", aliceKey)
+	send(t, alice, common.PacketMessage, encryptedMessage("1"))
+	send(t, alice, common.PacketMessage, encryptedMessage("2"))
+	send(t, alice, common.PacketMessage, encryptedMessage("3"))
+	expectError(t, alice, common.ErrCodeQuotaExceeded)
+}
+
+func TestOfflineQueueQuotaPerSender(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{MaxQueuedMessages: 3, MaxQueuedMessagesPerSender: 2})
+	aliceKey := register(t, ts, "alice")
+	register(t, ts, "bob")
+	carolKey := register(t, ts, "carol")
+
+	// Alice can't take all of bob's queue
+	alice := dial(t, ts)
+	authenticate(t, alice, "alice", aliceKey)
+	send(t, alice, common.PacketMessage, encryptedMessage("1"))
+	send(t, alice, common.PacketMessage, encryptedMessage("2"))
+	send(t, alice, common.PacketMessage, encryptedMessage("3"))
+	expectError(t, alice, common.ErrCodeQuotaExceeded)
+
+	// So there is still room for carol
+	carol := dial(t, ts)
+	authenticate(t, carol, "carol", carolKey)
+	message := encryptedMessage("1")
+	message.SenderID = "carol"
+	send(t, carol, common.PacketMessage, message)
+	send(t, carol, common.PacketMessage, &common.Message{ID: "2", SenderID: "carol", RecipientID: "bob", Content: "hi"})
+	expectError(t, carol, common.ErrCodeOffline)
+}
+
+func TestOfflineMessagesExpire(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{MessageTTL: 200 * time.Millisecond})
+	aliceKey := register(t, ts, "alice")
+	bobKey := register(t, ts, "bob")
+
+	alice := dial(t, ts)
+	authenticate(t, alice, "alice", aliceKey)
+	send(t, alice, common.PacketMessage, encryptedMessage("1"))
+	time.Sleep(300 * time.Millisecond)
+	send(t, alice, common.PacketMessage, encryptedMessage("2"))
+
+	bob := dial(t, ts)
+	authenticate(t, bob, "bob", bobKey)
+	expectMessage(t, bob, "2")
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Defaults for the limits in ServerConfig left at 0
+const (
+	DefaultMaxFrameSize        = 1 << 20
+	DefaultFrameRate           = 20
+	DefaultFrameBurst          = 60
+	DefaultIPFrameRate         = 100
+	DefaultIPFrameBurst        = 300
+	DefaultJoinRate            = 1
+	DefaultJoinBurst           = 20
+	DefaultMaxConnectionsPerIP = 32
+
+	// limitsSweepInterval is how often idle addresses are forgotten
+	limitsSweepInterval = time.Minute
+)
+
+// Resolves a config value where 0 means the default and negative means no limit, returned as 0
+func setting[T ~int | ~int64 | ~float64](value, def T) T {
+	switch {
+	case value == 0:
+		return def
+	case value < 0:
+		return 0
+	}
+	return value
+}
+
+// tokenBucket allows burst events at once and rate events per second after
+// that. A nil bucket allows everything.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := &tokenBucket{rate: rate, burst: float64(max(burst, 1)), last: time.Now()}
+	b.tokens = b.burst
+	return b
+}
+
+func (b *tokenBucket) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Reports whether the bucket has refilled, so forgetting it changes nothing
+func (b *tokenBucket) full() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// hostLimits is what one IP address has used up
+type hostLimits struct {
+	conns  int
+	frames *tokenBucket
+	joins  *tokenBucket
+}
+
+// ipLimits tracks every address with open connections or buckets still refilling
+type ipLimits struct {
+	hosts map[string]*hostLimits
+	mu    sync.Mutex
+}
+
+// Returns the address's limits, the caller must hold s.limits.mu
+func (s *Server) hostLimits(host string) *hostLimits {
+	h, ok := s.limits.hosts[host]
+	if !ok {
+		h = &hostLimits{
+			frames: newTokenBucket(
+				setting(s.config.IPFrameRate, DefaultIPFrameRate),
+				setting(s.config.IPFrameBurst, DefaultIPFrameBurst)),
+			joins: newTokenBucket(
+				setting(s.config.JoinRate, DefaultJoinRate),
+				setting(s.config.JoinBurst, DefaultJoinBurst)),
+		}
+		s.limits.hosts[host] = h
+	}
+	return h
+}
+
+// Counts a new connection from host. It returns false when the host already
+// has as many open as it may, otherwise release must be called once it closes.
+func (s *Server) acquireConnection(host string) (release func(), ok bool) {
+	s.limits.mu.Lock()
+	defer s.limits.mu.Unlock()
+
+	h := s.hostLimits(host)
+	if limit := setting(s.config.MaxConnectionsPerIP, DefaultMaxConnectionsPerIP); limit > 0 && h.conns >= limit {
+		return nil, false
+	}
+	h.conns++
+
+	return func() {
+		s.limits.mu.Lock()
+		h.conns--
+		s.limits.mu.Unlock()
+	}, true
+}
+
+// Takes a room join from the host's bucket
+func (s *Server) allowJoin(host string) bool {
+	s.limits.mu.Lock()
+	h := s.hostLimits(host)
+	s.limits.mu.Unlock()
+	return h.joins.allow()
+}
+
+// frameLimiter limits frames read from one connection, on their own and
+// together with every other connection from the same address
+type frameLimiter struct {
+	conn *tokenBucket
+	host *tokenBucket
+}
+
+func (s *Server) newFrameLimiter(host string) frameLimiter {
+	s.limits.mu.Lock()
+	h := s.hostLimits(host)
+	s.limits.mu.Unlock()
+
+	return frameLimiter{
+		conn: newTokenBucket(
+			setting(s.config.FrameRate, DefaultFrameRate),
+			setting(s.config.FrameBurst, DefaultFrameBurst)),
+		host: h.frames,
+	}
+}
+
+func (l frameLimiter) allow() bool {
+	return l.conn.allow() && l.host.allow()
+}
+
+// Sets the connection's frame size limit. Gorilla answers a bigger frame by
+// closing with code 1009 and failing the read.
+func (s *Server) limitFrameSize(conn *websocket.Conn) {
+	if limit := setting(s.config.MaxFrameSize, DefaultMaxFrameSize); limit > 0 {
+		conn.SetReadLimit(limit)
+	}
+}
+
+// Tells the peer which limit it tripped and closes the connection
+func closeForLimit(conn *websocket.Conn, reason string) {
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// Forgets addresses with nothing open and nothing left to refill
+func (s *Server) sweepLimits() {
+	ticker := time.NewTicker(limitsSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.limits.mu.Lock()
+			for host, h := range s.limits.hosts {
+				if h.conns == 0 && h.frames.full() && h.joins.full() {
+					delete(s.limits.hosts, host)
+				}
+			}
+			s.limits.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package server_test
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+// Reads until the server closes the connection and checks why
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, code) {
+				t.Fatalf("Expected close code %d, got %v", code, err)
+			}
+			return
+		}
+	}
+}
+
+func TestOversizedFrameCloses(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{MaxFrameSize: 1024})
+
+	conn := dialRoom(t, ts.URL, createRoom(t, ts.URL, 0).Room)
+	readEvent(t, conn)
+
+	conn.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte("x"), 2048))
+	expectClose(t, conn, websocket.CloseMessageTooBig)
+}
+
+func TestFrameRateLimit(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{FrameRate: 0.001, FrameBurst: 3})
+
+	conn := dialRoom(t, ts.URL, createRoom(t, ts.URL, 0).Room)
+	readEvent(t, conn)
+
+	for i := 0; i < 4; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"message"}`))
+	}
+	expectClose(t, conn, websocket.ClosePolicyViolation)
+}
+
+func TestConnectionsPerIPLimit(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{MaxConnectionsPerIP: 1})
+
+	room := createRoom(t, ts.URL, 0).Room
+	first := dialRoom(t, ts.URL, room)
+	readEvent(t, first)
+
+	second := dialRoom(t, ts.URL, room)
+	expectClose(t, second, websocket.ClosePolicyViolation)
+
+	// The slot frees up once the first connection is gone
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+	third := dialRoom(t, ts.URL, room)
+	if event := readEvent(t, third); event.Type != "welcome" {
+		t.Fatalf("Expected a welcome, got %+v", event)
+	}
+}
+
+func TestJoinRateLimit(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{JoinRate: 0.001, JoinBurst: 3})
+
+	// Creating the room takes from the same bucket as joining it
+	room := createRoom(t, ts.URL, 3).Room
+	readEvent(t, dialRoom(t, ts.URL, room))
+	readEvent(t, dialRoom(t, ts.URL, room))
+	expectClose(t, dialRoom(t, ts.URL, room), websocket.ClosePolicyViolation)
+
+	resp, err := http.Post(ts.URL+"/rooms", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to create a room: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected room creation to be limited too, got %s", resp.Status)
+	}
+}
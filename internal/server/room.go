@@ -0,0 +1,430 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultResumeWindow is used when ServerConfig.ResumeWindow is 0
+	DefaultResumeWindow = 2 * time.Minute
+
+	// DefaultRoomMembers is the capacity of a room whose creator didn't ask for one
+	DefaultRoomMembers = 2
+	// DefaultMaxRoomMembers is used when ServerConfig.MaxRoomMembers is 0
+	DefaultMaxRoomMembers = 16
+)
+
+// serverEvents are the frame types only the relay sends. Peers believe
+// them, so a member sending one is never passed on.
+var serverEvents = map[string]bool{
+	"welcome":       true,
+	"member_joined": true,
+	"member_left":   true,
+	"owner":         true,
+	"room_locked":   true,
+	"room_unlocked": true,
+	"room_error":    true,
+}
+
+// Room is a set of members relaying frames to each other. The member who
+// joins with the owner token from its creation owns it and may kick, ban and
+// lock; when they leave the longest standing member takes over.
+type Room struct {
+	Members    map[string]*member // by member ID
+	owner      string             // member ID of the owner
+	ownerToken string             // makes the member joining with it the owner, used once
+	channel    bool               // a short number anyone can guess, nobody gets in before the owner
+	capacity   int                // most members at once, 0 for no limit
+	locked     bool               // refusing new members, resumes still get in
+	banned     map[string]bool    // addresses refused by the owner
+	closed     bool               // removed from the server, joiners must make a new one
+	idle       *time.Timer        // drops the room while nobody is in it
+	lifetime   *time.Timer        // closes the room for good
+	mu         sync.Mutex
+}
+
+// member is a slot in a room. When its connection drops without a close
+// frame the slot is kept for the resume window, so the client can come back
+// with its resume token as the same member and peers keep their sessions.
+type member struct {
+	id      string
+	host    string // address the member joined from, a ban refuses it
+	joined  time.Time
+	token   string     // resume token, replaced on every attach
+	pump    *writePump // nil while detached
+	backlog []outgoing // frames that arrived while detached
+	expiry  *time.Timer
+}
+
+// memberEvent tells room members who joined or left. Members are identified
+// by a random ID so clients can keep one session per peer.
+type memberEvent struct {
+	Type    string `json:"type"`
+	Member  string `json:"member,omitempty"`
+	Resume  string `json:"resume,omitempty"`  // welcome only, the token to resume this slot with
+	Resumed bool   `json:"resumed,omitempty"` // welcome only, the slot was resumed rather than created
+	Owner   string `json:"owner,omitempty"`   // welcome only, the room owner's member ID
+	Locked  bool   `json:"locked,omitempty"`  // welcome only, whether the room is locked
+	Members int    `json:"members,omitempty"` // welcome only, how many the room holds, 0 for no limit
+	Message string `json:"message,omitempty"` // room_error only
+}
+
+// roomControl is sent by the owner to manage the room: kick or ban a member,
+// lock or unlock. The relay acts on it instead of passing it on.
+type roomControl struct {
+	Type   string `json:"type"`
+	Member string `json:"member,omitempty"`
+}
+
+func newMemberID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Queues a frame for every member except the given one, the caller must hold room.mu
+func (room *Room) broadcast(except *member, msg outgoing, backlogLimit int, stats *relayStats) {
+	for _, m := range room.Members {
+		if m == except {
+			continue
+		}
+		if m.pump != nil {
+			m.pump.send(msg)
+			continue
+		}
+
+		// Held for when the member resumes, oldest frames go first
+		m.backlog = append(m.backlog, msg)
+		if len(m.backlog) > backlogLimit {
+			m.backlog = m.backlog[1:]
+			stats.dropped.Add(1)
+		}
+	}
+}
+
+// Takes the member's resume token away so the slot can't be resumed, the
+// caller must not hold room.mu
+func (room *Room) revoke(m *member) {
+	room.mu.Lock()
+	m.token = ""
+	room.mu.Unlock()
+}
+
+// Finds the member a resume token belongs to, the caller must hold room.mu
+func (room *Room) resumable(token string) *member {
+	if token == "" {
+		return nil
+	}
+	for _, m := range room.Members {
+		if subtle.ConstantTimeCompare([]byte(m.token), []byte(token)) == 1 {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *Server) resumeWindow() time.Duration {
+	switch {
+	case s.config.ResumeWindow == 0:
+		return DefaultResumeWindow
+	case s.config.ResumeWindow < 0:
+		return 0
+	}
+	return s.config.ResumeWindow
+}
+
+func (s *Server) backlogLimit() int {
+	if s.config.SendQueueSize > 0 {
+		return s.config.SendQueueSize
+	}
+	return DefaultSendQueueSize
+}
+
+// Returns the capacity for a new room, the creator's request within the server's limit
+func (s *Server) roomCapacity(requested int) int {
+	capacity := requested
+	if capacity <= 0 {
+		capacity = DefaultRoomMembers
+	}
+	if limit := setting(s.config.MaxRoomMembers, DefaultMaxRoomMembers); limit > 0 {
+		capacity = min(capacity, limit)
+	}
+	return capacity
+}
+
+// Drops a member and tells the others. Once the room is empty it waits for
+// members again. The caller must hold room.mu.
+func (s *Server) removeMember(roomCode string, room *Room, m *member) {
+	if m.expiry != nil {
+		m.expiry.Stop()
+	}
+	delete(room.Members, m.id)
+
+	left, _ := json.Marshal(memberEvent{Type: "member_left", Member: m.id})
+	room.broadcast(m, fromRelay(left), s.backlogLimit(), &s.relayStats)
+
+	// The longest standing member takes over
+	if room.owner == m.id {
+		room.owner = ""
+		var oldest *member
+		for _, other := range room.Members {
+			if oldest == nil || other.joined.Before(oldest.joined) {
+				oldest = other
+			}
+		}
+		if oldest != nil {
+			room.owner = oldest.id
+			owner, _ := json.Marshal(memberEvent{Type: "owner", Member: oldest.id})
+			room.broadcast(nil, fromRelay(owner), s.backlogLimit(), &s.relayStats)
+		}
+	}
+
+	if len(room.Members) == 0 {
+		s.waitForMembers(roomCode, room)
+	}
+}
+
+// Says why a new member can't join, or "" if they can. The caller must hold room.mu.
+func (room *Room) refusal(host string, owner bool) string {
+	switch {
+	case room.banned[host]:
+		return common.RoomRefusedBanned
+	case room.channel && room.ownerToken != "" && !owner:
+		return common.RoomRefusedNoOwner
+	case room.locked:
+		return common.RoomRefusedLocked
+	case room.capacity > 0 && len(room.Members) >= room.capacity:
+		return common.RoomRefusedFull
+	}
+	return ""
+}
+
+// Joins the room, or resumes a slot in it when the token matches one, and
+// relays frames between the members until the connection drops. Only rooms
+// made with HandleCreateRoom can be joined.
+func (s *Server) handleRoom(conn *websocket.Conn, roomCode, resumeToken, ownerToken string) {
+	pump := s.newWritePump(conn)
+	defer pump.stop()
+
+	host := remoteHost(conn)
+	room := s.findRoom(roomCode)
+	if room == nil {
+		log.Printf("Refused a room join from %s: %s", host, common.RoomRefusedUnknown)
+		pump.close(websocket.ClosePolicyViolation, common.RoomRefusedUnknown)
+		return
+	}
+
+	m := room.resumable(resumeToken)
+	resumed := m != nil
+	if resumed {
+		if m.expiry != nil {
+			m.expiry.Stop()
+		}
+		// The old connection may not have noticed it is gone yet
+		if m.pump != nil {
+			m.pump.closeLater(websocket.CloseNormalClosure, "resumed elsewhere")
+		}
+	} else {
+		claimsOwner := room.ownerToken != "" && subtle.ConstantTimeCompare([]byte(room.ownerToken), []byte(ownerToken)) == 1
+		if reason := room.refusal(host, claimsOwner); reason != "" {
+			room.mu.Unlock()
+			log.Printf("Refused a room join from %s: %s", host, reason)
+			pump.close(websocket.ClosePolicyViolation, reason)
+			return
+		}
+
+		m = &member{id: newMemberID(), host: host, joined: time.Now()}
+		room.Members[m.id] = m
+		if room.idle != nil {
+			room.idle.Stop()
+		}
+
+		// The creator's token makes them the owner. Once it is used up, a
+		// room left without an owner goes to whoever comes in first.
+		switch {
+		case claimsOwner:
+			room.ownerToken = ""
+			room.owner = m.id
+			// Anyone who got in first learns who owns the room
+			owner, _ := json.Marshal(memberEvent{Type: "owner", Member: m.id})
+			room.broadcast(m, fromRelay(owner), s.backlogLimit(), &s.relayStats)
+		case room.owner == "" && room.ownerToken == "":
+			room.owner = m.id
+		}
+	}
+
+	m.token = randomHex(32)
+	m.pump = pump
+	welcome, _ := json.Marshal(memberEvent{
+		Type:    "welcome",
+		Member:  m.id,
+		Resume:  m.token,
+		Resumed: resumed,
+		Owner:   room.owner,
+		Locked:  room.locked,
+		Members: room.capacity,
+	})
+	pump.send(fromRelay(welcome))
+
+	if resumed {
+		for _, msg := range m.backlog {
+			pump.send(msg)
+		}
+		m.backlog = nil
+	} else {
+		joined, _ := json.Marshal(memberEvent{Type: "member_joined", Member: m.id})
+		room.broadcast(m, fromRelay(joined), s.backlogLimit(), &s.relayStats)
+	}
+	room.mu.Unlock()
+
+	if resumed {
+		log.Printf("Client resumed its slot in a room")
+	} else {
+		log.Printf("Client joined a room")
+	}
+
+	stopHeartbeat := s.heartbeat(conn)
+	defer stopHeartbeat()
+
+	// Message relay loop
+	limiter := s.newFrameLimiter(host)
+	var readErr error
+	limited := false
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			switch {
+			case isTimeout(err):
+				log.Printf("Dropping unresponsive room member")
+			case errors.Is(err, websocket.ErrReadLimit):
+				s.metrics.frameTooLarge.Add(1)
+				room.revoke(m)
+				limited = true
+			}
+			readErr = err
+			break
+		}
+
+		if !limiter.allow() {
+			s.metrics.frameLimited.Add(1)
+			// Revoked first, the client may be back before we get to drop the slot
+			room.revoke(m)
+			pump.close(websocket.ClosePolicyViolation, "sending too fast")
+			limited = true
+			break
+		}
+
+		// Frames that aren't JSON objects have no type and are relayed as
+		// they are, peers ignore them. One with a badly typed field still has
+		// its type decoded, and is checked all the same.
+		var control roomControl
+		json.Unmarshal(msg, &control)
+		if serverEvents[control.Type] {
+			continue
+		}
+		if s.handleRoomControl(roomCode, room, m, control) {
+			continue
+		}
+
+		// Broadcast to all other clients in the room
+		room.mu.Lock()
+		room.broadcast(m, fromMember(msg), s.backlogLimit(), &s.relayStats)
+		room.mu.Unlock()
+	}
+	conn.Close()
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	// A newer connection resumed the slot, or the owner kicked us, it is
+	// not ours to give up
+	if m.pump != pump {
+		return
+	}
+	m.pump = nil
+
+	// A client that says goodbye won't be back, one that broke the limits
+	// doesn't get to
+	window := s.resumeWindow()
+	if window == 0 || limited || websocket.IsCloseError(readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		s.removeMember(roomCode, room, m)
+		return
+	}
+
+	m.expiry = time.AfterFunc(window, func() {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if m.pump == nil && room.Members[m.id] == m {
+			s.removeMember(roomCode, room, m)
+		}
+	})
+}
+
+// Acts on a control frame from a member, reporting whether it was one. Only
+// the owner may use them.
+func (s *Server) handleRoomControl(roomCode string, room *Room, m *member, control roomControl) bool {
+	switch control.Type {
+	case "kick", "ban", "lock", "unlock":
+	default:
+		return false
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.owner != m.id {
+		s.sendRoomError(m, "only the room owner can "+control.Type)
+		return true
+	}
+
+	switch control.Type {
+	case "kick", "ban":
+		target, ok := room.Members[control.Member]
+		if !ok || target == m {
+			s.sendRoomError(m, "no such member")
+			return true
+		}
+
+		reason := common.RoomRefusedKicked
+		if control.Type == "ban" {
+			room.banned[target.host] = true
+			reason = common.RoomRefusedBanned
+		}
+
+		// Revoked so the slot can't be resumed, and detached so the
+		// target's handler leaves the rest to us
+		target.token = ""
+		if target.pump != nil {
+			target.pump.closeLater(websocket.ClosePolicyViolation, reason)
+			target.pump = nil
+		}
+		s.removeMember(roomCode, room, target)
+	case "lock", "unlock":
+		room.locked = control.Type == "lock"
+		event, _ := json.Marshal(memberEvent{Type: "room_" + control.Type + "ed"})
+		room.broadcast(nil, fromRelay(event), s.backlogLimit(), &s.relayStats)
+	}
+	return true
+}
+
+// Tells a member why their control frame was refused, the caller must hold room.mu
+func (s *Server) sendRoomError(m *member, message string) {
+	event, _ := json.Marshal(memberEvent{Type: "room_error", Message: message})
+	if m.pump != nil {
+		m.pump.send(fromRelay(event))
+	}
+}
@@ -0,0 +1,340 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+type roomEvent struct {
+	Type    string `json:"type"`
+	Member  string `json:"member"`
+	Resume  string `json:"resume"`
+	Resumed bool   `json:"resumed"`
+	Owner   string `json:"owner"`
+	Locked  bool   `json:"locked"`
+	Members int    `json:"members"`
+	Message string `json:"message"`
+	Text    string `json:"text"`
+}
+
+func readEvent(t *testing.T, conn *websocket.Conn) roomEvent {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var event roomEvent
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("Failed to read room event: %v", err)
+	}
+	return event
+}
+
+// Mints a room for members, 0 leaves the size to the server
+func createRoom(t *testing.T, url string, members int) common.CreateRoomResponse {
+	t.Helper()
+
+	body, _ := json.Marshal(common.CreateRoomRequest{Members: members})
+	resp, err := http.Post(url+"/rooms", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create a room: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Creating a room returned %s", resp.Status)
+	}
+
+	var created common.CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || created.Room == "" || created.OwnerToken == "" {
+		t.Fatalf("Invalid room: %+v %v", created, err)
+	}
+	return created
+}
+
+func TestRoomSlotResumes(t *testing.T) {
+	ts := newTestServer(t)
+
+	// Room for a third, who tries a spent token at the end
+	room := createRoom(t, ts.URL, 3).Room
+	alice := dialRoom(t, ts.URL, room)
+	welcome := readEvent(t, alice)
+	if welcome.Type != "welcome" || welcome.Resume == "" {
+		t.Fatalf("Expected a welcome with a resume token, got %+v", welcome)
+	}
+
+	bob := dialRoom(t, ts.URL, room)
+	readEvent(t, bob)
+	readEvent(t, alice) // bob joined
+
+	// Alice's connection dies without a close frame, bob keeps talking
+	alice.UnderlyingConn().Close()
+	time.Sleep(50 * time.Millisecond)
+	bob.WriteJSON(roomEvent{Type: "message", Text: "while you were away"})
+
+	alice = dialRoom(t, ts.URL, room+"&resume="+welcome.Resume)
+	resumed := readEvent(t, alice)
+	if !resumed.Resumed || resumed.Member != welcome.Member || resumed.Resume == welcome.Resume {
+		t.Fatalf("Expected to resume as %s with a new token, got %+v", welcome.Member, resumed)
+	}
+	if missed := readEvent(t, alice); missed.Text != "while you were away" {
+		t.Errorf("Expected the missed frame, got %+v", missed)
+	}
+
+	// Bob never saw alice leave
+	alice.WriteJSON(roomEvent{Type: "message", Text: "back"})
+	if event := readEvent(t, bob); event.Type != "message" || event.Text != "back" {
+		t.Errorf("Expected alice's message, got %+v", event)
+	}
+
+	// A used token doesn't work twice
+	mallory := dialRoom(t, ts.URL, room+"&resume="+welcome.Resume)
+	if event := readEvent(t, mallory); event.Resumed || event.Member == welcome.Member {
+		t.Errorf("Resumed with a spent token: %+v", event)
+	}
+}
+
+func TestRoomSlotExpires(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{ResumeWindow: 50 * time.Millisecond})
+
+	room := createRoom(t, ts.URL, 0).Room
+	alice := dialRoom(t, ts.URL, room)
+	welcome := readEvent(t, alice)
+	bob := dialRoom(t, ts.URL, room)
+	readEvent(t, bob)
+
+	alice.UnderlyingConn().Close()
+	if event := readEvent(t, bob); event.Type != "member_left" || event.Member != welcome.Member {
+		t.Fatalf("Expected alice to leave once her slot expired, got %+v", event)
+	}
+
+	alice = dialRoom(t, ts.URL, room+"&resume="+welcome.Resume)
+	if event := readEvent(t, alice); event.Resumed {
+		t.Errorf("Resumed an expired slot: %+v", event)
+	}
+}
+
+// Expects the server to turn the connection away for the given reason
+func expectRefused(t *testing.T, conn *websocket.Conn, reason string) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != reason {
+		t.Fatalf("Expected to be refused with %q, got %v", reason, err)
+	}
+}
+
+func TestRoomCapacity(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{MaxRoomMembers: 3})
+
+	room := createRoom(t, ts.URL, 0).Room
+	readEvent(t, dialRoom(t, ts.URL, room))
+	readEvent(t, dialRoom(t, ts.URL, room))
+	expectRefused(t, dialRoom(t, ts.URL, room), common.RoomRefusedFull)
+
+	// Asking for more than the server allows gets the most it allows
+	room = createRoom(t, ts.URL, 10).Room
+	for i := 0; i < 3; i++ {
+		if event := readEvent(t, dialRoom(t, ts.URL, room)); event.Type != "welcome" || event.Members != 3 {
+			t.Fatalf("Expected member %d to fit a room for 3, got %+v", i+1, event)
+		}
+	}
+	expectRefused(t, dialRoom(t, ts.URL, room), common.RoomRefusedFull)
+}
+
+func TestUnknownRoomRefused(t *testing.T) {
+	ts := newTestServer(t)
+
+	expectRefused(t, dialRoom(t, ts.URL, "NOSUCHROOM"), common.RoomRefusedUnknown)
+
+	// A typo is as good as a made up code
+	room := createRoom(t, ts.URL, 0).Room
+	expectRefused(t, dialRoom(t, ts.URL, room[1:]), common.RoomRefusedUnknown)
+}
+
+func TestRoomChannels(t *testing.T) {
+	ts := newTestServer(t)
+
+	body := bytes.NewReader([]byte(`{"channel":true}`))
+	resp, err := http.Post(ts.URL+"/rooms", "application/json", body)
+	if err != nil {
+		t.Fatalf("Failed to create a room: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var created common.CreateRoomResponse
+	json.NewDecoder(resp.Body).Decode(&created)
+	if n, err := strconv.Atoi(created.Room); err != nil || n < 1 || n > 1000 {
+		t.Fatalf("Expected a short channel number, got %q", created.Room)
+	}
+
+	// Someone who guessed the number can't take the slots before the owner
+	expectRefused(t, dialRoom(t, ts.URL, created.Room), common.RoomRefusedNoOwner)
+	if event := readEvent(t, dialRoom(t, ts.URL, created.Room+"&owner="+created.OwnerToken)); event.Type != "welcome" {
+		t.Fatalf("Expected the owner to join channel %s, got %+v", created.Room, event)
+	}
+	if event := readEvent(t, dialRoom(t, ts.URL, created.Room)); event.Type != "welcome" {
+		t.Errorf("Expected a peer to join channel %s after the owner, got %+v", created.Room, event)
+	}
+}
+
+func TestRoomExpires(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{
+		RoomJoinWindow: 50 * time.Millisecond,
+		RoomLifetime:   300 * time.Millisecond,
+	})
+
+	// Nobody joined in time
+	room := createRoom(t, ts.URL, 0).Room
+	time.Sleep(150 * time.Millisecond)
+	expectRefused(t, dialRoom(t, ts.URL, room), common.RoomRefusedUnknown)
+
+	// Members still in the room when it closes are told why
+	created := createRoom(t, ts.URL, 0)
+	if created.JoinBy.IsZero() || !created.Closes.After(created.JoinBy) {
+		t.Errorf("Expected the room's deadlines, got %+v", created)
+	}
+	alice := dialRoom(t, ts.URL, created.Room)
+	readEvent(t, alice)
+	expectRefused(t, alice, common.RoomRefusedExpired)
+	expectRefused(t, dialRoom(t, ts.URL, created.Room), common.RoomRefusedUnknown)
+}
+
+func TestRoomOwnerControls(t *testing.T) {
+	ts := newTestServer(t)
+
+	created := createRoom(t, ts.URL, 5)
+	room := created.Room
+
+	// Whoever gets in before the creator doesn't get to own the room
+	bob := dialRoom(t, ts.URL, room)
+	bobWelcome := readEvent(t, bob)
+	if bobWelcome.Owner != "" {
+		t.Fatalf("Expected no owner before the creator joins, got %+v", bobWelcome)
+	}
+
+	alice := dialRoom(t, ts.URL, room+"&owner="+created.OwnerToken)
+	welcome := readEvent(t, alice)
+	if welcome.Owner != welcome.Member {
+		t.Fatalf("Expected the creator to own the room, got %+v", welcome)
+	}
+	if event := readEvent(t, bob); event.Type != "owner" || event.Member != welcome.Member {
+		t.Fatalf("Expected to hear alice owns the room, got %+v", event)
+	}
+	readEvent(t, bob) // alice joined
+
+	// The token only works once
+	mallory := dialRoom(t, ts.URL, room+"&owner="+created.OwnerToken)
+	if event := readEvent(t, mallory); event.Owner != welcome.Member {
+		t.Fatalf("Took the room over with a spent owner token: %+v", event)
+	}
+	readEvent(t, alice) // mallory joined
+	readEvent(t, bob)
+	mallory.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	readEvent(t, alice) // mallory left
+	readEvent(t, bob)
+
+	// Only the owner gets to kick
+	bob.WriteJSON(map[string]string{"type": "kick", "member": welcome.Member})
+	if event := readEvent(t, bob); event.Type != "room_error" {
+		t.Fatalf("Expected bob's kick to be refused, got %+v", event)
+	}
+
+	alice.WriteJSON(map[string]string{"type": "kick", "member": bobWelcome.Member})
+	expectRefused(t, bob, common.RoomRefusedKicked)
+	if event := readEvent(t, alice); event.Type != "member_left" || event.Member != bobWelcome.Member {
+		t.Fatalf("Expected bob to leave, got %+v", event)
+	}
+
+	// A locked room takes no one new
+	alice.WriteJSON(map[string]string{"type": "lock"})
+	if event := readEvent(t, alice); event.Type != "room_locked" {
+		t.Fatalf("Expected the room to lock, got %+v", event)
+	}
+	expectRefused(t, dialRoom(t, ts.URL, room), common.RoomRefusedLocked)
+	alice.WriteJSON(map[string]string{"type": "unlock"})
+	readEvent(t, alice)
+
+	// A ban keeps the address out for good
+	carol := dialRoom(t, ts.URL, room)
+	carolWelcome := readEvent(t, carol)
+	readEvent(t, alice) // carol joined
+	alice.WriteJSON(map[string]string{"type": "ban", "member": carolWelcome.Member})
+	expectRefused(t, carol, common.RoomRefusedBanned)
+	readEvent(t, alice) // carol left
+	expectRefused(t, dialRoom(t, ts.URL, room), common.RoomRefusedBanned)
+}
+
+func TestRoomMembersCantSendServerEvents(t *testing.T) {
+	ts := newTestServer(t)
+
+	room := createRoom(t, ts.URL, 3).Room
+	alice := dialRoom(t, ts.URL, room)
+	aliceWelcome := readEvent(t, alice)
+	bob := dialRoom(t, ts.URL, room)
+	readEvent(t, bob)
+	readEvent(t, alice) // bob joined
+
+	// Mallory tries to make bob drop his session with alice
+	mallory := dialRoom(t, ts.URL, room)
+	readEvent(t, mallory)
+	readEvent(t, alice) // mallory joined
+	readEvent(t, bob)
+	mallory.WriteJSON(roomEvent{Type: "member_left", Member: aliceWelcome.Member})
+	mallory.WriteMessage(websocket.TextMessage, []byte(`{"type":"welcome","member":"x","locked":"yes"}`))
+	mallory.WriteJSON(roomEvent{Type: "message", Text: "hi"})
+
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		if event := readEvent(t, conn); event.Type != "message" || event.Text != "hi" {
+			t.Errorf("Expected only mallory's message, got %+v", event)
+		}
+	}
+}
+
+func TestRoomRelayedFramesAreBinary(t *testing.T) {
+	ts := newTestServer(t)
+
+	room := createRoom(t, ts.URL, 0).Room
+	alice := dialRoom(t, ts.URL, room)
+	readEvent(t, alice)
+	bob := dialRoom(t, ts.URL, room)
+	readEvent(t, bob)
+	bob.WriteJSON(roomEvent{Type: "message", Text: "hi"})
+
+	// Clients only believe the relay's events when they come as text
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []int{websocket.TextMessage, websocket.BinaryMessage} {
+		messageType, msg, err := alice.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if messageType != want {
+			t.Errorf("Expected message type %d for %s, got %d", want, msg, messageType)
+		}
+	}
+}
+
+func TestRoomOwnershipPasses(t *testing.T) {
+	ts := newTestServer(t)
+
+	created := createRoom(t, ts.URL, 0)
+	alice := dialRoom(t, ts.URL, created.Room+"&owner="+created.OwnerToken)
+	readEvent(t, alice)
+	bob := dialRoom(t, ts.URL, created.Room)
+	bobWelcome := readEvent(t, bob)
+
+	alice.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	readEvent(t, bob) // alice left
+	if event := readEvent(t, bob); event.Type != "owner" || event.Member != bobWelcome.Member {
+		t.Fatalf("Expected bob to take over the room, got %+v", event)
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultRoomJoinWindow is used when ServerConfig.RoomJoinWindow is 0
+	DefaultRoomJoinWindow = 10 * time.Minute
+	// DefaultRoomLifetime is used when ServerConfig.RoomLifetime is 0
+	DefaultRoomLifetime = 24 * time.Hour
+
+	// Room IDs use the clients' code alphabet, 10 characters give 50 bits:
+	// far too many to guess with the join rate limit in the way
+	roomIDAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	roomIDLength   = 10
+
+	// Channels are drawn from 1 up to firstChannels, ten times as many once
+	// a few draws in a row hit ones already taken
+	firstChannels = 1000
+	channelDraws  = 8
+)
+
+// HandleCreateRoom mints a room and answers with its ID and the token that
+// makes whoever joins with it the owner. Rooms only exist this way, joining
+// an unknown ID is refused.
+func (s *Server) HandleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// An empty body asks for the defaults
+	var req common.CreateRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Minting a room costs as much as joining one
+	if !s.allowJoin(requestHost(r)) {
+		s.metrics.joinLimited.Add(1)
+		http.Error(w, "Creating rooms too fast", http.StatusTooManyRequests)
+		return
+	}
+
+	resp := s.createRoom(req.Members, req.Channel)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Adds a room under an ID no other room has, and starts its clocks
+func (s *Server) createRoom(members int, channel bool) common.CreateRoomResponse {
+	now := time.Now()
+	room := &Room{
+		Members:    make(map[string]*member),
+		capacity:   s.roomCapacity(members),
+		banned:     make(map[string]bool),
+		ownerToken: randomHex(32),
+		channel:    channel,
+	}
+
+	s.roomsMu.Lock()
+	var roomID string
+	if channel {
+		roomID = s.newChannel()
+	} else {
+		// All digits would read as a channel
+		roomID = newRoomID()
+		for s.rooms[roomID] != nil || strings.Trim(roomID, "0123456789") == "" {
+			roomID = newRoomID()
+		}
+	}
+	s.rooms[roomID] = room
+	s.roomsMu.Unlock()
+
+	resp := common.CreateRoomResponse{Room: roomID, OwnerToken: room.ownerToken}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if window := setting(s.config.RoomJoinWindow, DefaultRoomJoinWindow); window > 0 {
+		resp.JoinBy = now.Add(window)
+	}
+	s.waitForMembers(roomID, room)
+
+	if lifetime := setting(s.config.RoomLifetime, DefaultRoomLifetime); lifetime > 0 {
+		resp.Closes = now.Add(lifetime)
+		room.lifetime = time.AfterFunc(lifetime, func() {
+			room.mu.Lock()
+			defer room.mu.Unlock()
+			if !room.closed {
+				s.closeRoom(roomID, room, common.RoomRefusedExpired)
+			}
+		})
+	}
+	return resp
+}
+
+func newRoomID() string {
+	b := make([]byte, roomIDLength)
+	for i := range b {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(roomIDAlphabet))))
+		b[i] = roomIDAlphabet[n.Int64()]
+	}
+	return string(b)
+}
+
+// Picks a free channel number, kept short while few are in use. Anyone can
+// guess one, but without the words after it in the code they can't talk to
+// the room, and nobody gets in before its creator. The caller must hold
+// s.roomsMu.
+func (s *Server) newChannel() string {
+	for limit := int64(firstChannels); ; limit *= 10 {
+		for i := 0; i < channelDraws; i++ {
+			n, _ := rand.Int(rand.Reader, big.NewInt(limit))
+			channel := strconv.FormatInt(n.Int64()+1, 10)
+			if s.rooms[channel] == nil {
+				return channel
+			}
+		}
+	}
+}
+
+// Returns the room locked, or nil if there is no such room
+func (s *Server) findRoom(roomID string) *Room {
+	s.roomsMu.Lock()
+	room := s.rooms[roomID]
+	s.roomsMu.Unlock()
+	if room == nil {
+		return nil
+	}
+
+	room.mu.Lock()
+	// Closed between the lookup and the lock
+	if room.closed {
+		room.mu.Unlock()
+		return nil
+	}
+	return room
+}
+
+// Drops the room if nobody is in it by the end of the join window, the
+// caller must hold room.mu
+func (s *Server) waitForMembers(roomID string, room *Room) {
+	window := setting(s.config.RoomJoinWindow, DefaultRoomJoinWindow)
+	if window == 0 {
+		return
+	}
+
+	room.idle = time.AfterFunc(window, func() {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if !room.closed && len(room.Members) == 0 {
+			s.closeRoom(roomID, room, "")
+		}
+	})
+}
+
+// Removes the room and disconnects whoever is still in it, the caller must hold room.mu
+func (s *Server) closeRoom(roomID string, room *Room, reason string) {
+	room.closed = true
+	if room.idle != nil {
+		room.idle.Stop()
+	}
+	if room.lifetime != nil {
+		room.lifetime.Stop()
+	}
+
+	// Detached, so each member's handler leaves the rest to us
+	for _, m := range room.Members {
+		if m.expiry != nil {
+			m.expiry.Stop()
+		}
+		if m.pump != nil {
+			m.pump.closeLater(websocket.ClosePolicyViolation, reason)
+			m.pump = nil
+		}
+	}
+
+	s.roomsMu.Lock()
+	delete(s.rooms, roomID)
+	s.roomsMu.Unlock()
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+// packetConn is a connection speaking common.Packet, as opposed to a room
+// connection that only relays frames
+type packetConn struct {
+	conn     *websocket.Conn
+	username string // bound once the challenge is answered
+	mu       sync.Mutex
+	writeMu  sync.Mutex
+}
+
+func (pc *packetConn) user() string {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.username
+}
+
+// Send writes a packet, safe to call from any goroutine
+func (pc *packetConn) Send(packetType string, data common.Payload) error {
+	packet, err := common.NewPacket(packetType, data)
+	if err != nil {
+		return err
+	}
+
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+	return pc.conn.WriteJSON(packet)
+}
+
+// sendError reports a refused packet back to the client
+func (pc *packetConn) sendError(err error) {
+	var payload *common.ErrorPayload
+	if !errors.As(err, &payload) {
+		payload = &common.ErrorPayload{Code: common.ErrCodeInternal, Message: err.Error()}
+	}
+
+	if err := pc.Send(common.PacketError, payload); err != nil {
+		log.Printf("Failed to send error packet: %v", err)
+	}
+}
+
+type route struct {
+	decode func(common.Packet) (common.Payload, error)
+	handle func(*packetConn, common.Payload) error
+}
+
+// Router dispatches packets to the handler registered for their type
+type Router struct {
+	routes map[string]route
+}
+
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]route)}
+}
+
+// Handle registers the handler for a packet type. The packet's Data is
+// decoded into a fresh P and validated before the handler sees it.
+func Handle[T any, P interface {
+	*T
+	common.Payload
+}](r *Router, packetType string, handler func(*packetConn, P) error) {
+	r.routes[packetType] = route{
+		decode: func(packet common.Packet) (common.Payload, error) {
+			payload := P(new(T))
+			return payload, packet.Decode(payload)
+		},
+		handle: func(pc *packetConn, payload common.Payload) error {
+			return handler(pc, payload.(P))
+		},
+	}
+}
+
+// Dispatch decodes a raw packet from an authenticated connection and runs its
+// handler. Every failure is returned as an *common.ErrorPayload fit to send
+// back to the client.
+func (r *Router) Dispatch(pc *packetConn, raw []byte) error {
+	var packet common.Packet
+	if err := json.Unmarshal(raw, &packet); err != nil {
+		return &common.ErrorPayload{Code: common.ErrCodeMalformed, Message: "not a packet"}
+	}
+
+	route, ok := r.routes[packet.Type]
+	if !ok {
+		return &common.ErrorPayload{Code: common.ErrCodeUnknownType, Message: "unknown packet type", Packet: packet.Type}
+	}
+
+	payload, err := route.decode(packet)
+	if err != nil {
+		return err
+	}
+
+	if err := route.handle(pc, payload); err != nil {
+		var errorPayload *common.ErrorPayload
+		if !errors.As(err, &errorPayload) {
+			errorPayload = &common.ErrorPayload{Code: common.ErrCodeInternal, Message: err.Error()}
+		}
+		if errorPayload.Packet == "" {
+			errorPayload.Packet = packet.Type
+		}
+		return errorPayload
+	}
+
+	return nil
+}
@@ -0,0 +1,270 @@
+package server_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/Theknighttron/Xtty/internal/server"
+	"github.com/gorilla/websocket"
+)
+
+// testDialer offers the subprotocol the server insists on
+var testDialer = &websocket.Dialer{
+	Subprotocols:     []string{common.Subprotocol},
+	HandshakeTimeout: 5 * time.Second,
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	return newTestServerWithConfig(t, common.ServerConfig{})
+}
+
+func newTestServerWithConfig(t *testing.T, config common.ServerConfig) *httptest.Server {
+	return newTestServerWithStore(t, config, server.NewMemoryUserStore())
+}
+
+func newTestServerWithStore(t *testing.T, config common.ServerConfig, store server.UserStore) *httptest.Server {
+	s := server.NewServerWithStore(config, store)
+	t.Cleanup(s.Close)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.HandleWebSocket)
+	mux.HandleFunc("/register", s.HandleRegistration)
+	mux.HandleFunc("/users/rotate-key", s.HandleKeyRotation)
+	mux.HandleFunc("/users/delete", s.HandleAccountDeletion)
+	mux.HandleFunc("/metrics", s.HandleMetrics)
+	mux.HandleFunc("/rooms", s.HandleCreateRoom)
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// Registers a user with a fresh identity key and returns the key
+func register(t *testing.T, ts *httptest.Server, username string) crypto.Signer {
+	key, err := common.GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	registerKey(t, ts, username, key)
+	return key
+}
+
+func registerKey(t *testing.T, ts *httptest.Server, username string, key crypto.Signer) {
+	publicKey, err := common.EncodePublicKeyToPEM(key.Public())
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"username": username, "public_key": publicKey})
+	resp, err := http.Post(ts.URL+"/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to register %s: %v", username, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Registering %s returned %s", username, resp.Status)
+	}
+}
+
+func dial(t *testing.T, ts *httptest.Server) *websocket.Conn {
+	conn, _, err := testDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func send(t *testing.T, conn *websocket.Conn, packetType string, data common.Payload) {
+	packet, err := common.NewPacket(packetType, data)
+	if err != nil {
+		t.Fatalf("Failed to build packet: %v", err)
+	}
+	if err := conn.WriteJSON(packet); err != nil {
+		t.Fatalf("Failed to send packet: %v", err)
+	}
+}
+
+func receive(t *testing.T, conn *websocket.Conn) common.Packet {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var packet common.Packet
+	if err := conn.ReadJSON(&packet); err != nil {
+		t.Fatalf("Failed to read packet: %v", err)
+	}
+	return packet
+}
+
+func expectError(t *testing.T, conn *websocket.Conn, code string) {
+	t.Helper()
+
+	packet := receive(t, conn)
+	if packet.Type != common.PacketError {
+		t.Fatalf("Expected an error packet, got %q", packet.Type)
+	}
+
+	var payload common.ErrorPayload
+	if err := packet.Decode(&payload); err != nil {
+		t.Fatalf("Invalid error packet: %v", err)
+	}
+	if payload.Code != code {
+		t.Errorf("Expected error code %q, got %q (%s)", code, payload.Code, payload.Message)
+	}
+}
+
+// Answers the server's challenge with a signature from key
+func answerChallenge(t *testing.T, conn *websocket.Conn, username string, key crypto.Signer) {
+	var challenge common.ChallengePayload
+	packet := receive(t, conn)
+	if packet.Type != common.PacketChallenge || packet.Decode(&challenge) != nil {
+		t.Fatalf("Expected a challenge, got %q", packet.Type)
+	}
+
+	signature := ed25519.Sign(key.(ed25519.PrivateKey), common.AuthChallengeMessage(username, challenge.Nonce))
+	send(t, conn, common.PacketAuth, &common.AuthPayload{Username: username, Signature: signature})
+}
+
+func authenticate(t *testing.T, conn *websocket.Conn, username string, key crypto.Signer) {
+	answerChallenge(t, conn, username, key)
+	if packet := receive(t, conn); packet.Type != common.PacketAuthOK {
+		t.Fatalf("Expected auth_ok for %s, got %q %s", username, packet.Type, packet.Data)
+	}
+}
+
+func TestChallengeResponseAuth(t *testing.T) {
+	ts := newTestServer(t)
+	aliceKey := register(t, ts, "alice")
+	malloryKey := register(t, ts, "mallory")
+
+	// A signature from another user's key is refused
+	conn := dial(t, ts)
+	answerChallenge(t, conn, "alice", malloryKey)
+	expectError(t, conn, common.ErrCodeUnauthenticated)
+
+	// Anything but an auth packet is refused too
+	conn = dial(t, ts)
+	receive(t, conn)
+	send(t, conn, common.PacketTyping, &common.TypingPayload{From: "alice", To: "bob", Typing: true})
+	expectError(t, conn, common.ErrCodeUnauthenticated)
+
+	conn = dial(t, ts)
+	authenticate(t, conn, "alice", aliceKey)
+}
+
+func TestFriendsStatusOnLogin(t *testing.T) {
+	store := server.NewMemoryUserStore()
+	ts := newTestServerWithStore(t, common.ServerConfig{}, store)
+	aliceKey := register(t, ts, "alice")
+	bobKey := register(t, ts, "bob")
+	store.Update("alice", func(user *common.User) error {
+		user.FriendList = []string{"bob"}
+		return nil
+	})
+
+	bob := dial(t, ts)
+	authenticate(t, bob, "bob", bobKey)
+	send(t, bob, common.PacketStatus, &common.StatusPayload{Username: "bob", Status: common.StatusAway})
+
+	// Wait for the status to be taken, bob's other packets are answered in order
+	send(t, bob, common.PacketTyping, &common.TypingPayload{From: "bob", To: "nobody", Typing: true})
+	expectError(t, bob, common.ErrCodeNotFound)
+
+	alice := dial(t, ts)
+	authenticate(t, alice, "alice", aliceKey)
+	var status common.StatusPayload
+	packet := receive(t, alice)
+	if packet.Type != common.PacketStatus || packet.Decode(&status) != nil {
+		t.Fatalf("Expected bob's status, got %q %s", packet.Type, packet.Data)
+	}
+	if status.Username != "bob" || status.Status != common.StatusAway {
+		t.Errorf("Expected bob to be away, got %+v", status)
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	ts := newTestServer(t)
+	register(t, ts, "alice")
+	malloryKey := register(t, ts, "mallory")
+
+	for i := 0; i < server.MaxAuthFailures; i++ {
+		conn := dial(t, ts)
+		answerChallenge(t, conn, "alice", malloryKey)
+		expectError(t, conn, common.ErrCodeUnauthenticated)
+	}
+
+	// The address is locked out before it even gets another challenge
+	conn := dial(t, ts)
+	expectError(t, conn, common.ErrCodeLocked)
+}
+
+func TestRegistrationRefusesBadUsernames(t *testing.T) {
+	ts := newTestServer(t)
+	key, err := common.GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	publicKey, _ := common.EncodePublicKeyToPEM(key.Public())
+
+	for _, username := range []string{"", "alice bob", "alice\n"} {
+		body, _ := json.Marshal(map[string]interface{}{"username": username, "public_key": publicKey})
+		resp, err := http.Post(ts.URL+"/register", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to register %q: %v", username, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %q to be refused, got %s", username, resp.Status)
+		}
+	}
+}
+
+func TestPacketRouterRejectsBadPackets(t *testing.T) {
+	ts := newTestServer(t)
+	conn := dial(t, ts)
+	authenticate(t, conn, "alice", register(t, ts, "alice"))
+
+	conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	expectError(t, conn, common.ErrCodeMalformed)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"teleport","data":{}}`))
+	expectError(t, conn, common.ErrCodeUnknownType)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"typing","data":{"from":"alice","recipient":"bob"}}`))
+	expectError(t, conn, common.ErrCodeMalformed)
+
+	send(t, conn, common.PacketTyping, &common.TypingPayload{From: "alice"})
+	expectError(t, conn, common.ErrCodeInvalid)
+}
+
+func TestPacketRouterDeliversMessages(t *testing.T) {
+	ts := newTestServer(t)
+	aliceKey := register(t, ts, "alice")
+	bobKey := register(t, ts, "bob")
+
+	alice := dial(t, ts)
+	authenticate(t, alice, "alice", aliceKey)
+
+	message := &common.Message{ID: "1", SenderID: "alice", RecipientID: "bob", Content: "hi"}
+	send(t, alice, common.PacketMessage, message)
+	expectError(t, alice, common.ErrCodeOffline)
+
+	bob := dial(t, ts)
+	authenticate(t, bob, "bob", bobKey)
+
+	send(t, alice, common.PacketMessage, message)
+	packet := receive(t, bob)
+	var received common.Message
+	if packet.Type != common.PacketMessage || packet.Decode(&received) != nil || received.Content != "hi" {
+		t.Fatalf("Bob didn't receive the message, got %q %s", packet.Type, packet.Data)
+	}
+
+	// Packets can't be sent in someone else's name
+	send(t, bob, common.PacketTyping, &common.TypingPayload{From: "alice", To: "alice", Typing: true})
+	expectError(t, bob, common.ErrCodeForbidden)
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+var (
+	// ErrUserExists is returned when creating a user whose name is taken
+	ErrUserExists = errors.New("username already taken")
+	// ErrUserNotFound is returned for usernames that aren't registered
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// UserStore keeps registered users
+type UserStore interface {
+	// Create adds a user, failing with ErrUserExists if the name is taken
+	Create(user common.User) error
+	// Get returns a user or ErrUserNotFound
+	Get(username string) (common.User, error)
+	// Update changes a user in place. fn sees the current record and the
+	// change is only stored if it returns nil.
+	Update(username string, fn func(*common.User) error) error
+	// Delete removes a user, freeing the username
+	Delete(username string) error
+	Close() error
+}
+
+// MemoryUserStore keeps users in memory, they are gone when the server stops
+type MemoryUserStore struct {
+	users map[string]common.User
+	mu    sync.RWMutex
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[string]common.User)}
+}
+
+func (m *MemoryUserStore) Create(user common.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.users[user.Username]; exists {
+		return ErrUserExists
+	}
+	m.users[user.Username] = cloneUser(user)
+	return nil
+}
+
+func (m *MemoryUserStore) Get(username string) (common.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return common.User{}, ErrUserNotFound
+	}
+	return cloneUser(user), nil
+}
+
+func (m *MemoryUserStore) Update(username string, fn func(*common.User) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	user = cloneUser(user)
+	if err := fn(&user); err != nil {
+		return err
+	}
+	m.users[username] = user
+	return nil
+}
+
+func (m *MemoryUserStore) Delete(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.users[username]; !exists {
+		return ErrUserNotFound
+	}
+	delete(m.users, username)
+	return nil
+}
+
+func (m *MemoryUserStore) Close() error {
+	return nil
+}
+
+// Handlers get their own copies, so they can't change a stored user behind the store's back
+func cloneUser(user common.User) common.User {
+	user.PublicKey = slices.Clone(user.PublicKey)
+	user.FriendList = slices.Clone(user.FriendList)
+	return user
+}
+
+const (
+	snapshotFile = "users.json"
+	logFile      = "users.log"
+
+	// compactAfter is how many log records are written before they are folded into the snapshot
+	compactAfter = 1000
+)
+
+// logRecord is one line of the append-only log
+type logRecord struct {
+	Op   string      `json:"op"` // "put" or "delete"
+	User common.User `json:"user"`
+}
+
+// FileUserStore keeps users on disk as a snapshot plus an append-only log of
+// changes since it was taken. Every change is synced to the log before it is
+// acknowledged; once the log is long enough it is folded into a new snapshot.
+type FileUserStore struct {
+	dir     string
+	memory  *MemoryUserStore
+	log     *os.File
+	records int // records in the log since the last snapshot
+	mu      sync.Mutex
+}
+
+// OpenFileUserStore loads the users stored in dir, creating it if needed
+func OpenFileUserStore(dir string) (*FileUserStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &FileUserStore{dir: dir, memory: NewMemoryUserStore()}
+
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replayLog(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	s.log, err = os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileUserStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var users []common.User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("corrupt user snapshot: %v", err)
+	}
+	for _, user := range users {
+		s.memory.users[user.Username] = user
+	}
+	return nil
+}
+
+func (s *FileUserStore) replayLog() error {
+	file, err := os.Open(filepath.Join(s.dir, logFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// A crash in the middle of an append, the change was never acknowledged
+				log.Printf("Discarding incomplete record at the end of the user log")
+				return os.Truncate(filepath.Join(s.dir, logFile), valid)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var record logRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("corrupt user log: %v", err)
+		}
+		switch record.Op {
+		case "put":
+			s.memory.users[record.User.Username] = record.User
+		case "delete":
+			delete(s.memory.users, record.User.Username)
+		default:
+			return fmt.Errorf("corrupt user log: unknown op %q", record.Op)
+		}
+
+		valid += int64(len(line))
+		s.records++
+	}
+}
+
+// Appends a record and syncs it, s.mu must be held
+func (s *FileUserStore) appendRecord(record logRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// A failed append is cut off again: a partial line would stop the next
+	// start, and a refused change mustn't come back with it
+	offset, err := s.log.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Write(append(line, '\n')); err != nil {
+		return s.truncateLog(offset, err)
+	}
+	if err := s.log.Sync(); err != nil {
+		return s.truncateLog(offset, err)
+	}
+
+	s.records++
+	return nil
+}
+
+// Cuts the log back to offset after an append failed with cause, s.mu must be held
+func (s *FileUserStore) truncateLog(offset int64, cause error) error {
+	if err := s.log.Truncate(offset); err != nil {
+		return fmt.Errorf("%w, and failed to undo the append: %v", cause, err)
+	}
+	if _, err := s.log.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("%w, and failed to undo the append: %v", cause, err)
+	}
+	s.log.Sync()
+	return cause
+}
+
+// Folds the log into the snapshot once it is long enough. Call it after the
+// change is applied in memory, so the snapshot includes it. s.mu must be held.
+func (s *FileUserStore) maybeCompact() {
+	if s.records < compactAfter {
+		return
+	}
+	if err := s.compact(); err != nil {
+		// The log still has everything, compaction can wait for the next write
+		log.Printf("Failed to compact user store: %v", err)
+	}
+}
+
+// Writes every user to a new snapshot and empties the log, s.mu must be held
+func (s *FileUserStore) compact() error {
+	s.memory.mu.RLock()
+	users := slices.Collect(maps.Values(s.memory.users))
+	s.memory.mu.RUnlock()
+
+	data, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename, so a crash leaves either the old snapshot or the new one
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	// Replaying the old log over the new snapshot would be harmless, so a
+	// crash before the truncate loses nothing
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	s.records = 0
+	return nil
+}
+
+func (s *FileUserStore) Create(user common.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.memory.Get(user.Username); err == nil {
+		return ErrUserExists
+	}
+	if err := s.appendRecord(logRecord{Op: "put", User: user}); err != nil {
+		return err
+	}
+	if err := s.memory.Create(user); err != nil {
+		return err
+	}
+
+	s.maybeCompact()
+	return nil
+}
+
+func (s *FileUserStore) Get(username string) (common.User, error) {
+	return s.memory.Get(username)
+}
+
+func (s *FileUserStore) Update(username string, fn func(*common.User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.memory.Get(username)
+	if err != nil {
+		return err
+	}
+	if err := fn(&user); err != nil {
+		return err
+	}
+	if err := s.appendRecord(logRecord{Op: "put", User: user}); err != nil {
+		return err
+	}
+
+	s.memory.Update(username, func(stored *common.User) error {
+		*stored = user
+		return nil
+	})
+
+	s.maybeCompact()
+	return nil
+}
+
+func (s *FileUserStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.memory.Get(username); err != nil {
+		return err
+	}
+	if err := s.appendRecord(logRecord{Op: "delete", User: common.User{Username: username}}); err != nil {
+		return err
+	}
+	s.memory.Delete(username)
+
+	s.maybeCompact()
+	return nil
+}
+
+func (s *FileUserStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
@@ -0,0 +1,82 @@
+package server_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/Theknighttron/Xtty/internal/server"
+)
+
+func TestFileUserStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := server.OpenFileUserStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	store.Create(common.User{Username: "alice", PublicKey: []byte("alice key")})
+	store.Create(common.User{Username: "bob", PublicKey: []byte("bob key")})
+	if err := store.Create(common.User{Username: "alice"}); !errors.Is(err, server.ErrUserExists) {
+		t.Errorf("Expected ErrUserExists, got %v", err)
+	}
+	store.Update("alice", func(user *common.User) error {
+		user.PublicKey = []byte("new alice key")
+		return nil
+	})
+	store.Delete("bob")
+	store.Close()
+
+	store, err = server.OpenFileUserStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	alice, err := store.Get("alice")
+	if err != nil || string(alice.PublicKey) != "new alice key" {
+		t.Errorf("Alice's rotated key was lost: %q %v", alice.PublicKey, err)
+	}
+	if _, err := store.Get("bob"); !errors.Is(err, server.ErrUserNotFound) {
+		t.Errorf("Deleted user came back: %v", err)
+	}
+}
+
+func TestFileUserStoreDiscardsTornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := server.OpenFileUserStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	store.Create(common.User{Username: "alice"})
+	store.Close()
+
+	// A crash halfway through appending bob
+	log, _ := os.OpenFile(filepath.Join(dir, "users.log"), os.O_WRONLY|os.O_APPEND, 0600)
+	log.WriteString(`{"op":"put","user":{"username":"bo`)
+	log.Close()
+
+	store, err = server.OpenFileUserStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store after a torn write: %v", err)
+	}
+	if _, err := store.Get("alice"); err != nil {
+		t.Errorf("Alice was lost: %v", err)
+	}
+
+	// New records must not be glued onto the torn one
+	store.Create(common.User{Username: "carol"})
+	store.Close()
+
+	store, err = server.OpenFileUserStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Get("carol"); err != nil {
+		t.Errorf("Carol was lost: %v", err)
+	}
+}
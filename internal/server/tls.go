@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+)
+
+const (
+	selfSignedCertFile = "tls-cert.pem"
+	selfSignedKeyFile  = "tls-key.pem"
+
+	// selfSignedValidity is how long a generated certificate lasts before a
+	// new one, with a new fingerprint, replaces it
+	selfSignedValidity = 365 * 24 * time.Hour
+)
+
+// TLSOptions says where the server's certificate comes from and whether
+// clients must present one
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// SelfSigned generates a certificate when no files are given. It is kept
+	// in SelfSignedDir, if set, so its fingerprint survives restarts.
+	SelfSigned    bool
+	SelfSignedDir string
+	Hosts         []string // names and addresses the generated certificate is valid for
+
+	// ClientCAFile, if set, makes clients present a certificate signed by one of its CAs
+	ClientCAFile string
+}
+
+// NewTLSConfig builds the server's TLS config and returns the fingerprint of
+// its certificate, for clients that pin it
+func NewTLSConfig(opts TLSOptions) (*tls.Config, string, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case opts.CertFile != "" || opts.KeyFile != "":
+		cert, err = tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	case opts.SelfSigned:
+		cert, err = loadOrCreateSelfSigned(opts.SelfSignedDir, opts.Hosts)
+	default:
+		return nil, "", errors.New("no certificate: give a certificate and key, or ask for a self-signed one")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if opts.ClientCAFile != "" {
+		pool, err := loadCertPool(opts.ClientCAFile)
+		if err != nil {
+			return nil, "", err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, common.CertificateFingerprint(cert.Certificate[0]), nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// Reuses the certificate in dir while it is valid, otherwise makes a new one
+func loadOrCreateSelfSigned(dir string, hosts []string) (tls.Certificate, error) {
+	if dir != "" {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, selfSignedCertFile), filepath.Join(dir, selfSignedKeyFile))
+		if err == nil && time.Now().Before(cert.Leaf.NotAfter) {
+			return cert, nil
+		}
+	}
+
+	certPEM, keyPEM, err := generateSelfSigned(hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, selfSignedKeyFile), keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, selfSignedCertFile), certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func generateSelfSigned(hosts []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "xtty self-signed"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
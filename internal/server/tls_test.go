@@ -0,0 +1,144 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Theknighttron/Xtty/internal/client"
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/Theknighttron/Xtty/internal/server"
+)
+
+func newTLSTestServer(t *testing.T, opts server.TLSOptions) (*httptest.Server, string) {
+	tlsConfig, fingerprint, err := server.NewTLSConfig(opts)
+	if err != nil {
+		t.Fatalf("Failed to set up TLS: %v", err)
+	}
+
+	s := server.NewServer(common.ServerConfig{})
+	t.Cleanup(s.Close)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(s.HandleWebSocket))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts, fingerprint
+}
+
+// A client config pointing at the test server
+func tlsClientConfig(t *testing.T, ts *httptest.Server) *client.Config {
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return &client.Config{ServerHost: u.Hostname(), ServerPort: port, TLS: true}
+}
+
+func dialRoomWith(config *client.Config) error {
+	dialer, err := config.Dialer()
+	if err != nil {
+		return err
+	}
+	conn, _, err := dialer.Dial(config.ServerURL()+"/ws?room=ABCD", nil)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func TestSelfSignedCertificatePinning(t *testing.T) {
+	dir := t.TempDir()
+	ts, fingerprint := newTLSTestServer(t, server.TLSOptions{SelfSigned: true, SelfSignedDir: dir, Hosts: []string{"127.0.0.1"}})
+
+	// The certificate is kept, so the pinned fingerprint survives a restart
+	if _, again, err := server.NewTLSConfig(server.TLSOptions{SelfSigned: true, SelfSignedDir: dir}); err != nil || again != fingerprint {
+		t.Errorf("Fingerprint changed on restart: %s != %s (%v)", again, fingerprint, err)
+	}
+
+	config := tlsClientConfig(t, ts)
+	if err := dialRoomWith(config); err == nil {
+		t.Error("Connected to a self-signed server without pinning it")
+	}
+
+	config.TLSFingerprint = fingerprint
+	if err := dialRoomWith(config); err != nil {
+		t.Errorf("Failed to connect with the pinned fingerprint: %v", err)
+	}
+
+	other, _, _ := server.NewTLSConfig(server.TLSOptions{SelfSigned: true})
+	config.TLSFingerprint = common.CertificateFingerprint(other.Certificates[0].Certificate[0])
+	if err := dialRoomWith(config); !errors.Is(err, client.ErrFingerprintMismatch) {
+		t.Errorf("Expected a fingerprint mismatch, got %v", err)
+	}
+}
+
+// Writes a certificate and key signed by parent, or self-signed if parent is nil
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "xtty test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "alice", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	ts, fingerprint := newTLSTestServer(t, server.TLSOptions{
+		SelfSigned:   true,
+		Hosts:        []string{"127.0.0.1"},
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	})
+
+	config := tlsClientConfig(t, ts)
+	config.TLSFingerprint = fingerprint
+	if err := dialRoomWith(config); err == nil {
+		t.Error("Connected without a client certificate")
+	}
+
+	config.TLSCertFile = filepath.Join(dir, "alice.pem")
+	config.TLSKeyFile = filepath.Join(dir, "alice-key.pem")
+	if err := dialRoomWith(config); err != nil {
+		t.Errorf("Failed to connect with a client certificate: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+// Convert http connection into websocket connection. checkUpgrade has
+// already vetted the origin and subprotocol.
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{common.Subprotocol},
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// Turns away requests from web pages that aren't allowed and from clients
+// that don't speak our subprotocol. The reason is logged, but never the
+// request URL, it carries the room code.
+func (s *Server) checkUpgrade(w http.ResponseWriter, r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" && !s.originAllowed(origin, r.Host) {
+		s.metrics.badOrigin.Add(1)
+		log.Printf("Rejected WebSocket from %s: origin %q is not allowed", requestHost(r), origin)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return false
+	}
+
+	if !slices.Contains(websocket.Subprotocols(r), common.Subprotocol) {
+		s.metrics.badSubprotocol.Add(1)
+		log.Printf("Rejected WebSocket from %s: subprotocol %s not offered", requestHost(r), common.Subprotocol)
+		http.Error(w, "Unsupported client, offer the "+common.Subprotocol+" subprotocol", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// A page may connect to the server it was served from, or from an origin on
+// the allowlist
+func (s *Server) originAllowed(origin, host string) bool {
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, host) {
+		return true
+	}
+
+	origin = strings.TrimSuffix(origin, "/")
+	for _, allowed := range s.config.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,51 @@
+package server_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Theknighttron/Xtty/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+func TestUpgradePolicy(t *testing.T) {
+	ts := newTestServerWithConfig(t, common.ServerConfig{AllowedOrigins: []string{"https://chat.example.com"}})
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?room=ABCD"
+
+	tests := []struct {
+		name     string
+		origin   string
+		dialer   *websocket.Dialer
+		expected int
+	}{
+		{"no origin", "", testDialer, http.StatusSwitchingProtocols},
+		{"same origin", ts.URL, testDialer, http.StatusSwitchingProtocols},
+		{"allowed origin", "https://CHAT.example.com", testDialer, http.StatusSwitchingProtocols},
+		{"foreign origin", "https://evil.example.net", testDialer, http.StatusForbidden},
+		{"no subprotocol", "", websocket.DefaultDialer, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+
+			conn, resp, err := tt.dialer.Dial(url, header)
+			if conn != nil {
+				if conn.Subprotocol() != common.Subprotocol {
+					t.Errorf("Negotiated subprotocol %q", conn.Subprotocol())
+				}
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("No response: %v", err)
+			}
+			if resp.StatusCode != tt.expected {
+				t.Errorf("Expected status %d, got %d", tt.expected, resp.StatusCode)
+			}
+		})
+	}
+}